@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	gzipWriters  sync.Pool
+	flateWriters sync.Pool
+)
+
+// compress encodes responses with gzip or deflate when the client accepts
+// it. Responses that end, or are flushed, before reaching the minimum size
+// are sent as they are.
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.compression.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			minSize:        app.compression.MinSize,
+			level:          app.compression.Level,
+			status:         http.StatusOK,
+		}
+		defer func() {
+			// After a panic a response that was not sent yet is dropped,
+			// so that recoverPanic can still send a 500. An aborted one is
+			// not finished, so that it does not look complete.
+			if p := recover(); p != nil {
+				if cw.decided && p != http.ErrAbortHandler {
+					cw.Close()
+				}
+				panic(p)
+			}
+			cw.Close()
+		}()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip, or returns an empty string if neither is acceptable.
+func negotiateEncoding(header string) string {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			weight = parsed
+		}
+		q[strings.ToLower(strings.TrimSpace(name))] = weight
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range []string{"gzip", "deflate"} {
+		weight, ok := q[encoding]
+		if !ok {
+			weight, ok = q["*"]
+		}
+		if ok && weight > bestQ {
+			best, bestQ = encoding, weight
+		}
+	}
+
+	return best
+}
+
+// compressWriter buffers the start of a response until it knows whether
+// the response is large enough to be worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	level    int
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         bytes.Buffer
+	encoder     io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+
+	// Bodiless and already encoded responses pass through untouched.
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified ||
+		cw.Header().Get("Content-Encoding") != "" {
+		cw.decided = true
+		cw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf.Write(b)
+	if cw.buf.Len() >= cw.minSize {
+		err := cw.start(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// start sends the header and the buffered body, compressed or not.
+func (cw *compressWriter) start(compress bool) error {
+	cw.decided = true
+
+	if compress {
+		cw.Header().Del("Content-Length")
+		cw.Header().Set("Content-Encoding", cw.encoding)
+		cw.encoder = cw.newEncoder()
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf.Reset()
+
+	return err
+}
+
+func (cw *compressWriter) newEncoder() io.WriteCloser {
+	switch cw.encoding {
+	case "gzip":
+		if gz, ok := gzipWriters.Get().(*gzip.Writer); ok {
+			gz.Reset(cw.ResponseWriter)
+			return gz
+		}
+		gz, err := gzip.NewWriterLevel(cw.ResponseWriter, cw.level)
+		if err != nil {
+			gz = gzip.NewWriter(cw.ResponseWriter)
+		}
+		return gz
+	default:
+		if fw, ok := flateWriters.Get().(*flate.Writer); ok {
+			fw.Reset(cw.ResponseWriter)
+			return fw
+		}
+		fw, err := flate.NewWriter(cw.ResponseWriter, cw.level)
+		if err != nil {
+			fw, _ = flate.NewWriter(cw.ResponseWriter, flate.DefaultCompression)
+		}
+		return fw
+	}
+}
+
+// Flush sends what has been written so far. A response flushed before it
+// reached the minimum size is streamed uncompressed.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if !cw.wroteHeader {
+			cw.WriteHeader(http.StatusOK)
+		}
+		if !cw.decided {
+			cw.start(false)
+		}
+	}
+
+	switch encoder := cw.encoder.(type) {
+	case *gzip.Writer:
+		encoder.Flush()
+	case *flate.Writer:
+		encoder.Flush()
+	}
+
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close finishes the response, sending a short one uncompressed.
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if !cw.wroteHeader {
+			// Nothing was written, the handler relies on the implicit 200.
+			if cw.buf.Len() == 0 {
+				return nil
+			}
+		}
+		err := cw.start(false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cw.encoder == nil {
+		return nil
+	}
+
+	err := cw.encoder.Close()
+	switch encoder := cw.encoder.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(encoder)
+	case *flate.Writer:
+		flateWriters.Put(encoder)
+	}
+	cw.encoder = nil
+
+	return err
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
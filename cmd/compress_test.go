@@ -0,0 +1,132 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/edzh1/rest-effective-mobile/internal/config"
+)
+
+func TestCompress(t *testing.T) {
+	small := strings.Repeat("a", 99)
+	large := strings.Repeat("a", 100)
+
+	write := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		}
+	}
+	status := func(code int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		handler        http.HandlerFunc
+		wantStatus     int
+		wantEncoding   string
+		wantBody       string
+	}{
+		{name: "Below minimum size", acceptEncoding: "gzip", handler: write(small), wantStatus: http.StatusOK, wantBody: small},
+		{name: "At minimum size", acceptEncoding: "gzip", handler: write(large), wantStatus: http.StatusOK, wantEncoding: "gzip", wantBody: large},
+		{name: "Reaching minimum size over writes", acceptEncoding: "gzip", handler: func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, small)
+			io.WriteString(w, "b")
+		}, wantStatus: http.StatusOK, wantEncoding: "gzip", wantBody: small + "b"},
+		{name: "Deflate", acceptEncoding: "deflate", handler: write(large), wantStatus: http.StatusOK, wantEncoding: "deflate", wantBody: large},
+		{name: "Gzip preferred", acceptEncoding: "deflate, gzip", handler: write(large), wantStatus: http.StatusOK, wantEncoding: "gzip", wantBody: large},
+		{name: "Gzip refused", acceptEncoding: "gzip;q=0, deflate", handler: write(large), wantStatus: http.StatusOK, wantEncoding: "deflate", wantBody: large},
+		{name: "Everything refused", acceptEncoding: "gzip;q=0, *;q=0", handler: write(large), wantStatus: http.StatusOK, wantBody: large},
+		{name: "Wildcard", acceptEncoding: "*", handler: write(large), wantStatus: http.StatusOK, wantEncoding: "gzip", wantBody: large},
+		{name: "Not accepted", handler: write(large), wantStatus: http.StatusOK, wantBody: large},
+		{name: "Flush before minimum size", acceptEncoding: "gzip", handler: func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "a")
+			http.NewResponseController(w).Flush()
+			io.WriteString(w, large)
+		}, wantStatus: http.StatusOK, wantBody: "a" + large},
+		{name: "Flush after minimum size", acceptEncoding: "gzip", handler: func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, large)
+			http.NewResponseController(w).Flush()
+			io.WriteString(w, "b")
+		}, wantStatus: http.StatusOK, wantEncoding: "gzip", wantBody: large + "b"},
+		{name: "Already encoded", acceptEncoding: "gzip", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "br")
+			io.WriteString(w, large)
+		}, wantStatus: http.StatusOK, wantEncoding: "br", wantBody: large},
+		{name: "Not Modified", acceptEncoding: "gzip", handler: status(http.StatusNotModified), wantStatus: http.StatusNotModified},
+		{name: "No Content", acceptEncoding: "gzip", handler: status(http.StatusNoContent), wantStatus: http.StatusNoContent},
+		{name: "Status without body", acceptEncoding: "gzip", handler: status(http.StatusAccepted), wantStatus: http.StatusAccepted},
+		{name: "HEAD", method: http.MethodHead, acceptEncoding: "gzip", handler: write(large), wantStatus: http.StatusOK, wantBody: large},
+		{name: "Panic before writing", acceptEncoding: "gzip", handler: func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}, wantStatus: http.StatusInternalServerError, wantBody: "Internal Server Error\n"},
+		{name: "Panic with a buffered body", acceptEncoding: "gzip", handler: func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, small)
+			panic("boom")
+		}, wantStatus: http.StatusInternalServerError, wantBody: "Internal Server Error\n"},
+	}
+
+	app := newTestApplication(t)
+	app.compression = config.Compression{Enabled: true, MinSize: 100, Level: -1}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			handler := app.recoverPanic(app.compress(tt.handler))
+
+			// Encoders are pooled, so the second request reuses the first's.
+			for range 2 {
+				r := httptest.NewRequest(method, "/", nil)
+				if tt.acceptEncoding != "" {
+					r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+				}
+
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, r)
+				res := rr.Result()
+
+				if res.StatusCode != tt.wantStatus {
+					t.Fatalf("got status %d; want %d", res.StatusCode, tt.wantStatus)
+				}
+				if got := res.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+					t.Errorf("got Content-Encoding %q; want %q", got, tt.wantEncoding)
+				}
+				if got := res.Header.Values("Vary"); len(got) != 1 || got[0] != "Accept-Encoding" {
+					t.Errorf("got Vary %q; want Accept-Encoding once", got)
+				}
+
+				var body io.Reader = res.Body
+				switch tt.wantEncoding {
+				case "gzip":
+					gz, err := gzip.NewReader(res.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					body = gz
+				case "deflate":
+					body = flate.NewReader(res.Body)
+				}
+
+				got, err := io.ReadAll(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != tt.wantBody {
+					t.Errorf("got body %q; want %q", got, tt.wantBody)
+				}
+			}
+		})
+	}
+}
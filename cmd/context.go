@@ -0,0 +1,12 @@
+package main
+
+type contextKey string
+
+const (
+	responseFormatContextKey = contextKey("responseFormat")
+	apiKeyContextKey         = contextKey("apiKey")
+	identityContextKey       = contextKey("identity")
+	tenantContextKey         = contextKey("tenant")
+	loggerContextKey         = contextKey("logger")
+	graphqlContextKey        = contextKey("graphql")
+)
@@ -0,0 +1,714 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/edzh1/rest-effective-mobile/internal/models"
+	"github.com/google/uuid"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+const (
+	graphqlDefaultFirst = 20
+	graphqlMaxFirst     = 100
+)
+
+type graphqlRequestBody struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+	Extensions    map[string]any `json:"extensions,omitempty"`
+}
+
+type graphqlResponse struct {
+	Data       any              `json:"data"`
+	Errors     []map[string]any `json:"errors,omitempty"`
+	Extensions map[string]any   `json:"extensions,omitempty"`
+}
+
+// graphqlState is what the resolvers of a request share: the caller for the
+// sticky window, the batched loader of services and the overlap warnings.
+type graphqlState struct {
+	client   string
+	services *serviceLoader
+
+	mu       sync.Mutex
+	warnings []string
+}
+
+func (s *graphqlState) warn(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.warnings = append(s.warnings, msg)
+}
+
+func graphqlStateFrom(ctx context.Context) *graphqlState {
+	state, _ := ctx.Value(graphqlContextKey).(*graphqlState)
+	return state
+}
+
+// serviceLoader batches the lookups of services made while a level of the
+// query resolves. load queues a name and returns a thunk; the first thunk to
+// run fetches every queued name with one query.
+type serviceLoader struct {
+	fetch func(names []string) ([]models.Service, error)
+
+	mu      sync.Mutex
+	pending map[string]bool
+	loaded  map[string]models.Service
+	errs    map[string]error
+}
+
+func newServiceLoader(fetch func(names []string) ([]models.Service, error)) *serviceLoader {
+	return &serviceLoader{
+		fetch:   fetch,
+		pending: make(map[string]bool),
+		loaded:  make(map[string]models.Service),
+		errs:    make(map[string]error),
+	}
+}
+
+func (l *serviceLoader) load(name string) func() (any, error) {
+	l.mu.Lock()
+	if _, ok := l.loaded[name]; !ok && l.errs[name] == nil {
+		l.pending[name] = true
+	}
+	l.mu.Unlock()
+
+	return func() (any, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if len(l.pending) > 0 {
+			names := make([]string, 0, len(l.pending))
+			for name := range l.pending {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			clear(l.pending)
+
+			services, err := l.fetch(names)
+			for _, name := range names {
+				// Services the caller no longer has a subscription to come
+				// back empty.
+				l.loaded[name] = models.Service{Name: name}
+				if err != nil {
+					l.errs[name] = err
+				}
+			}
+			for _, service := range services {
+				l.loaded[service.Name] = service
+			}
+		}
+
+		if err := l.errs[name]; err != nil {
+			return nil, err
+		}
+		return l.loaded[name], nil
+	}
+}
+
+// field resolves a field of a Go value of type T.
+func field[T any](typ graphql.Output, description string, get func(T) any) *graphql.Field {
+	return &graphql.Field{
+		Type:        typ,
+		Description: description,
+		Resolve: func(p graphql.ResolveParams) (any, error) {
+			return get(p.Source.(T)), nil
+		},
+	}
+}
+
+// subscriptionPage is a page of the subscriptions connection.
+type subscriptionPage struct {
+	subscriptions []models.Subscription
+	hasNextPage   bool
+}
+
+// encodeCursor turns the id of a subscription into an opaque cursor.
+func encodeCursor(id uuid.UUID) string {
+	return base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+func decodeCursor(cursor string) (uuid.UUID, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.FromBytes(b)
+}
+
+// newGraphQLSchema builds the schema served at /graphql. Resolvers check the
+// scope of their field, so that a query mixing subscriptions and reports
+// returns what the caller may see.
+func (app *application) newGraphQLSchema() (graphql.Schema, error) {
+	nonNullString := graphql.NewNonNull(graphql.String)
+	nonNullInt := graphql.NewNonNull(graphql.Int)
+	nonNullID := graphql.NewNonNull(graphql.ID)
+
+	service := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Service",
+		Description: "A service as seen through the subscriptions of the caller.",
+		Fields: graphql.Fields{
+			"name":          field(nonNullString, "", func(s models.Service) any { return s.Name }),
+			"subscriptions": field(nonNullInt, "Number of subscriptions.", func(s models.Service) any { return s.Subscriptions }),
+			"users":         field(nonNullInt, "Number of subscribed users.", func(s models.Service) any { return s.Users }),
+			"minPrice":      field(nonNullInt, "", func(s models.Service) any { return s.MinPrice }),
+			"maxPrice":      field(nonNullInt, "", func(s models.Service) any { return s.MaxPrice }),
+		},
+	})
+
+	subscription := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "UserSubscription",
+		Description: "Dates are formatted as YYYY-MM-DD.",
+		Fields: graphql.Fields{
+			"id":          field(nonNullID, "", func(s models.Subscription) any { return s.ID.String() }),
+			"userId":      field(nonNullID, "", func(s models.Subscription) any { return s.UserID.String() }),
+			"serviceName": field(nonNullString, "", func(s models.Subscription) any { return s.ServiceName }),
+			"price":       field(nonNullInt, "", func(s models.Subscription) any { return s.Price }),
+			"startDate":   field(nonNullString, "", func(s models.Subscription) any { return s.StartDate.Format(time.DateOnly) }),
+			"endDate": field(graphql.String, "Null if the subscription has no end.", func(s models.Subscription) any {
+				if s.EndDate == nil {
+					return nil
+				}
+				return s.EndDate.Format(time.DateOnly)
+			}),
+			"service": &graphql.Field{
+				Type:        graphql.NewNonNull(service),
+				Description: "Requires the reports.read scope.",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					if err := app.graphqlScope(p.Context, models.ScopeReportsRead); err != nil {
+						return nil, err
+					}
+					return graphqlStateFrom(p.Context).services.load(p.Source.(models.Subscription).ServiceName), nil
+				},
+			},
+		},
+	})
+
+	edge := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserSubscriptionEdge",
+		Fields: graphql.Fields{
+			"cursor": field(nonNullString, "", func(s models.Subscription) any { return encodeCursor(s.ID) }),
+			"node":   field(graphql.NewNonNull(subscription), "", func(s models.Subscription) any { return s }),
+		},
+	})
+
+	pageInfo := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageInfo",
+		Fields: graphql.Fields{
+			"endCursor": field(graphql.String, "", func(p subscriptionPage) any {
+				if len(p.subscriptions) == 0 {
+					return nil
+				}
+				return encodeCursor(p.subscriptions[len(p.subscriptions)-1].ID)
+			}),
+			"hasNextPage": field(graphql.NewNonNull(graphql.Boolean), "", func(p subscriptionPage) any { return p.hasNextPage }),
+		},
+	})
+
+	connection := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserSubscriptionConnection",
+		Fields: graphql.Fields{
+			"edges":    field(graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(edge))), "", func(p subscriptionPage) any { return p.subscriptions }),
+			"pageInfo": field(graphql.NewNonNull(pageInfo), "", func(p subscriptionPage) any { return p }),
+		},
+	})
+
+	serviceTotal := graphql.NewObject(graphql.ObjectConfig{
+		Name: "ServiceTotal",
+		Fields: graphql.Fields{
+			"serviceName":   field(nonNullString, "", func(t models.ServiceTotal) any { return t.ServiceName }),
+			"total":         field(nonNullInt, "", func(t models.ServiceTotal) any { return t.Total }),
+			"subscriptions": field(nonNullInt, "", func(t models.ServiceTotal) any { return t.Subscriptions }),
+		},
+	})
+
+	filter := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:        "SubscriptionFilter",
+		Description: "Selects subscriptions like the query parameters of the REST API. Dates are formatted as YYYY-MM-DD.",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"userId":      &graphql.InputObjectFieldConfig{Type: graphql.ID},
+			"serviceName": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"startDate":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"endDate":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	input := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:        "UserSubscriptionInput",
+		Description: "Dates are formatted as YYYY-MM-DD.",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"userId":      &graphql.InputObjectFieldConfig{Type: nonNullID},
+			"serviceName": &graphql.InputObjectFieldConfig{Type: nonNullString},
+			"price":       &graphql.InputObjectFieldConfig{Type: nonNullInt},
+			"startDate":   &graphql.InputObjectFieldConfig{Type: nonNullString},
+			"endDate":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	filterArgs := graphql.FieldConfigArgument{
+		"filter": &graphql.ArgumentConfig{Type: filter},
+	}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"subscription": &graphql.Field{
+				Type: subscription,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: nonNullID},
+				},
+				Resolve: app.resolveSubscription,
+			},
+			"subscriptions": &graphql.Field{
+				Type:        graphql.NewNonNull(connection),
+				Description: "Pages through the subscriptions matching the filter in the order of their ids.",
+				Args: graphql.FieldConfigArgument{
+					"filter": &graphql.ArgumentConfig{Type: filter},
+					"first": &graphql.ArgumentConfig{
+						Type:         graphql.Int,
+						DefaultValue: graphqlDefaultFirst,
+						Description:  fmt.Sprintf("From 1 to %d.", graphqlMaxFirst),
+					},
+					"after": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: app.resolveSubscriptions,
+			},
+			"total": &graphql.Field{
+				Type:        nonNullInt,
+				Description: "Sums the prices of the subscriptions matching the filter.",
+				Args:        filterArgs,
+				Resolve:     app.resolveTotal,
+			},
+			"totalsByService": &graphql.Field{
+				Type:    graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(serviceTotal))),
+				Args:    filterArgs,
+				Resolve: app.resolveTotalsByService,
+			},
+			"services": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(service))),
+				Description: "Lists the services with subscriptions, all of them if names is omitted.",
+				Args: graphql.FieldConfigArgument{
+					"names": &graphql.ArgumentConfig{Type: graphql.NewList(nonNullString)},
+				},
+				Resolve: app.resolveServices,
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createSubscription": &graphql.Field{
+				Type: graphql.NewNonNull(subscription),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(input)},
+				},
+				Resolve: app.resolveCreateSubscription,
+			},
+			"updateSubscription": &graphql.Field{
+				Type: graphql.NewNonNull(subscription),
+				Args: graphql.FieldConfigArgument{
+					"id":    &graphql.ArgumentConfig{Type: nonNullID},
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(input)},
+				},
+				Resolve: app.resolveUpdateSubscription,
+			},
+			"deleteSubscription": &graphql.Field{
+				Type: nonNullID,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: nonNullID},
+				},
+				Resolve: app.resolveDeleteSubscription,
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+// graphqlQuery godoc
+// @Summary Query subscriptions with GraphQL
+// @Description Runs a GraphQL query or mutation over subscriptions, totals and services; the schema is available through introspection. Operations deeper or more complex than the configured limits are rejected. Errors of single fields are returned with status 200 next to the data of the others.
+// @Tags graphql
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param X-Tenant-ID header string false "Tenant of the caller; only admins may access another tenant"
+// @Param X-Read-Primary header bool false "Read from the primary database"
+// @Param Idempotency-Key header string false "Unique key to safely retry a mutation"
+// @Param request body graphqlRequestBody true "GraphQL request"
+// @Success 200 {object} graphqlResponse
+// @Failure 400 {object} graphqlResponse
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 409 {string} string "Request with this Idempotency-Key is in progress"
+// @Failure 415 {string} string "Unsupported Media Type"
+// @Failure 422 {string} string "Idempotency-Key was used with a different request"
+// @Failure 429 {string} string "Too Many Requests"
+// @Router /graphql [post]
+func (app *application) graphqlQuery(w http.ResponseWriter, r *http.Request) {
+	var body graphqlRequestBody
+	if !app.readJSON(w, r, &body) {
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(body.Query), Name: "GraphQL request"}),
+	})
+
+	// Mutations are charged to the write budget, everything else, including
+	// queries that fail to parse, to the report budget.
+	class := rateLimitReport
+	if err == nil {
+		if operation := graphqlOperation(doc, body.OperationName); operation != nil && operation.Operation == ast.OperationTypeMutation {
+			class = rateLimitWrite
+		}
+	}
+	if !app.takeRateLimit(w, r, class) {
+		return
+	}
+
+	if err != nil {
+		app.writeJSON(w, r, http.StatusBadRequest, &graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+
+	validation := graphql.ValidateDocument(&app.graphqlSchema, doc, nil)
+	if !validation.IsValid {
+		app.writeJSON(w, r, http.StatusBadRequest, &graphql.Result{Errors: validation.Errors})
+		return
+	}
+
+	err = app.graphqlLimits.check(doc, body.OperationName, body.Variables)
+	if err != nil {
+		app.writeJSON(w, r, http.StatusBadRequest, &graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+
+	ctx := app.readContext(r)
+	model := app.subscriptionsFor(ctx)
+	ownerID := ownerIDFrom(ctx)
+
+	state := &graphqlState{
+		client: app.clientID(r),
+		services: newServiceLoader(func(names []string) ([]models.Service, error) {
+			return model.Services(ctx, names, ownerID)
+		}),
+	}
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        app.graphqlSchema,
+		AST:           doc,
+		OperationName: body.OperationName,
+		Args:          body.Variables,
+		Context:       context.WithValue(ctx, graphqlContextKey, state),
+	})
+
+	if len(state.warnings) > 0 {
+		if result.Extensions == nil {
+			result.Extensions = make(map[string]any)
+		}
+		result.Extensions["warnings"] = state.warnings
+	}
+
+	app.writeJSON(w, r, http.StatusOK, result)
+}
+
+// graphqlScope checks scope for a field the same way requireScope does for a
+// route.
+func (app *application) graphqlScope(ctx context.Context, scope string) error {
+	switch app.checkScope(ctx, scope) {
+	case errUnauthenticated:
+		return errors.New("Unauthorized")
+	case errForbidden:
+		return errors.New("Forbidden")
+	}
+	return nil
+}
+
+// graphqlError logs err and turns it into the message of a field error the
+// same way serverError turns it into an HTTP response.
+func (app *application) graphqlError(ctx context.Context, field string, err error) error {
+	logger := app.loggerFrom(ctx)
+
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+		return errors.New("Not Found")
+	case errors.Is(err, context.Canceled):
+		logger.InfoContext(ctx, "request canceled", "field", field)
+		return errors.New("Canceled")
+	case errors.Is(err, models.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		logger.ErrorContext(ctx, err.Error(), "field", field)
+		return errors.New("Gateway Timeout")
+	case errors.Is(err, models.ErrUnavailable):
+		logger.ErrorContext(ctx, err.Error(), "field", field)
+		return errors.New("Service Unavailable")
+	}
+
+	logger.ErrorContext(ctx, err.Error(), "field", field, "trace", string(debug.Stack()))
+	return errors.New("Internal Server Error")
+}
+
+// graphqlFilter validates the filter argument with the rules of the REST
+// query parameters and limits it to the caller.
+func graphqlFilter(ctx context.Context, args map[string]any) (models.SubscriptionFilter, error) {
+	f, _ := args["filter"].(map[string]any)
+	get := func(key string) string {
+		s, _ := f[key].(string)
+		return s
+	}
+
+	filter, err := readSubscriptionFilter(filterQuery(get("userId"), get("serviceName"), get("startDate"), get("endDate")))
+	if err != nil {
+		return filter, err
+	}
+
+	if !restrictFilter(&filter, ownerIDFrom(ctx)) {
+		return filter, errors.New("Forbidden")
+	}
+
+	return filter, nil
+}
+
+func (app *application) resolveSubscription(p graphql.ResolveParams) (any, error) {
+	if err := app.graphqlScope(p.Context, models.ScopeSubscriptionsRead); err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.Parse(p.Args["id"].(string))
+	if err != nil {
+		return nil, errors.New("Invalid UUID format")
+	}
+
+	subscription, err := app.subscriptionsFor(p.Context).Get(p.Context, id, ownerIDFrom(p.Context))
+	if errors.Is(err, models.ErrNoRecord) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, app.graphqlError(p.Context, "subscription", err)
+	}
+
+	return subscription, nil
+}
+
+func (app *application) resolveSubscriptions(p graphql.ResolveParams) (any, error) {
+	if err := app.graphqlScope(p.Context, models.ScopeSubscriptionsRead); err != nil {
+		return nil, err
+	}
+
+	filter, err := graphqlFilter(p.Context, p.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	first, _ := p.Args["first"].(int)
+	if first < 1 || first > graphqlMaxFirst {
+		return nil, fmt.Errorf("first must be between 1 and %d", graphqlMaxFirst)
+	}
+
+	if after, ok := p.Args["after"].(string); ok {
+		id, err := decodeCursor(after)
+		if err != nil {
+			return nil, errors.New("Invalid cursor")
+		}
+		filter.After = &id
+	}
+
+	// One more row than asked tells whether there is a next page.
+	limit := first + 1
+	filter.Limit = &limit
+
+	subscriptions, err := app.subscriptionsFor(p.Context).List(p.Context, filter)
+	if err != nil {
+		return nil, app.graphqlError(p.Context, "subscriptions", err)
+	}
+
+	page := subscriptionPage{subscriptions: subscriptions}
+	if len(subscriptions) > first {
+		page.subscriptions, page.hasNextPage = subscriptions[:first], true
+	}
+
+	return page, nil
+}
+
+func (app *application) resolveTotal(p graphql.ResolveParams) (any, error) {
+	if err := app.graphqlScope(p.Context, models.ScopeReportsRead); err != nil {
+		return nil, err
+	}
+
+	filter, err := graphqlFilter(p.Context, p.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := app.subscriptionsFor(p.Context).CountTotal(p.Context, filter)
+	if err != nil {
+		return nil, app.graphqlError(p.Context, "total", err)
+	}
+
+	return total, nil
+}
+
+func (app *application) resolveTotalsByService(p graphql.ResolveParams) (any, error) {
+	if err := app.graphqlScope(p.Context, models.ScopeReportsRead); err != nil {
+		return nil, err
+	}
+
+	filter, err := graphqlFilter(p.Context, p.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	totals, err := app.subscriptionsFor(p.Context).TotalsByService(p.Context, filter)
+	if err != nil {
+		return nil, app.graphqlError(p.Context, "totalsByService", err)
+	}
+
+	return totals, nil
+}
+
+func (app *application) resolveServices(p graphql.ResolveParams) (any, error) {
+	if err := app.graphqlScope(p.Context, models.ScopeReportsRead); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if list, ok := p.Args["names"].([]any); ok {
+		names = make([]string, 0, len(list))
+		for _, name := range list {
+			names = append(names, name.(string))
+		}
+	}
+
+	services, err := app.subscriptionsFor(p.Context).Services(p.Context, names, ownerIDFrom(p.Context))
+	if err != nil {
+		return nil, app.graphqlError(p.Context, "services", err)
+	}
+
+	return services, nil
+}
+
+// subscriptionInput validates the input argument of a mutation with
+// prepareSubscription.
+func (app *application) subscriptionInput(ctx context.Context, args map[string]any) (models.Subscription, error) {
+	in := args["input"].(map[string]any)
+
+	body := subscriptionCreateBody{
+		UserID:      in["userId"].(string),
+		ServiceName: in["serviceName"].(string),
+		Price:       in["price"].(int),
+		StartDate:   in["startDate"].(string),
+	}
+	body.EndDate, _ = in["endDate"].(string)
+
+	subscription, err := app.prepareSubscription(ctx, body)
+	if errors.Is(err, errForbidden) {
+		return subscription, errors.New("Forbidden")
+	}
+
+	return subscription, err
+}
+
+// graphqlWarnOverlaps reports the overlaps of a written subscription in the
+// warnings extension of the response.
+func (app *application) graphqlWarnOverlaps(ctx context.Context, subscription models.Subscription, overlapping []models.Subscription) {
+	if warning := app.overlapWarning(ctx, subscription, overlapping); warning != "" {
+		graphqlStateFrom(ctx).warn(warning)
+	}
+}
+
+// graphqlWriteError treats failures of Insert and Update other than overlaps
+// and those of the database as invalid input, like the REST handlers do.
+func (app *application) graphqlWriteError(ctx context.Context, field string, err error) error {
+	var overlapErr *models.OverlapError
+	if errors.As(err, &overlapErr) {
+		return errors.New(overlapMessage(overlapErr.Subscriptions))
+	}
+	if errors.Is(err, models.ErrNoRecord) || isDatabaseFailure(err) {
+		return app.graphqlError(ctx, field, err)
+	}
+	return errors.New("Bad Request")
+}
+
+func (app *application) resolveCreateSubscription(p graphql.ResolveParams) (any, error) {
+	if err := app.graphqlScope(p.Context, models.ScopeSubscriptionsWrite); err != nil {
+		return nil, err
+	}
+
+	subscription, err := app.subscriptionInput(p.Context, p.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	id, overlapping, err := app.subscriptionsFor(p.Context).Insert(p.Context, subscription.UserID.String(), subscription.ServiceName, subscription.Price, subscription.StartDate, subscription.EndDate)
+	if err != nil {
+		return nil, app.graphqlWriteError(p.Context, "createSubscription", err)
+	}
+	app.graphqlWarnOverlaps(p.Context, subscription, overlapping)
+
+	app.sticky.wrote(graphqlStateFrom(p.Context).client)
+
+	subscription.ID = id
+	return subscription, nil
+}
+
+func (app *application) resolveUpdateSubscription(p graphql.ResolveParams) (any, error) {
+	if err := app.graphqlScope(p.Context, models.ScopeSubscriptionsWrite); err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.Parse(p.Args["id"].(string))
+	if err != nil {
+		return nil, errors.New("Invalid UUID format")
+	}
+
+	subscription, err := app.subscriptionInput(p.Context, p.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	_, overlapping, err := app.subscriptionsFor(p.Context).Update(p.Context, id, ownerIDFrom(p.Context), subscription.UserID.String(), subscription.ServiceName, subscription.Price, subscription.StartDate, subscription.EndDate)
+	if err != nil {
+		return nil, app.graphqlWriteError(p.Context, "updateSubscription", err)
+	}
+	app.graphqlWarnOverlaps(p.Context, subscription, overlapping)
+
+	app.sticky.wrote(graphqlStateFrom(p.Context).client)
+
+	subscription.ID = id
+	return subscription, nil
+}
+
+func (app *application) resolveDeleteSubscription(p graphql.ResolveParams) (any, error) {
+	if err := app.graphqlScope(p.Context, models.ScopeSubscriptionsWrite); err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.Parse(p.Args["id"].(string))
+	if err != nil {
+		return nil, errors.New("Invalid UUID format")
+	}
+
+	err = app.subscriptionsFor(p.Context).Delete(p.Context, id, ownerIDFrom(p.Context))
+	if err != nil {
+		return nil, app.graphqlError(p.Context, "deleteSubscription", err)
+	}
+
+	app.sticky.wrote(graphqlStateFrom(p.Context).client)
+
+	return id.String(), nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// introspectionMaxDepth bounds the nesting of introspection fields instead of
+// the configured depth, which the type references of the usual introspection
+// query exceed.
+const introspectionMaxDepth = 15
+
+// queryLimits rejects GraphQL operations that nest too deeply or would
+// resolve too many fields. Fields with a first argument are lists whose
+// selections are counted once per requested item. Introspection fields count
+// toward the complexity like any other, but their depth is limited by
+// introspectionMaxDepth.
+type queryLimits struct {
+	maxDepth      int
+	maxComplexity int
+}
+
+func (l queryLimits) check(doc *ast.Document, operationName string, variables map[string]any) error {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, def := range doc.Definitions {
+		if def, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[def.Name.Value] = def
+		}
+	}
+
+	operation := graphqlOperation(doc, operationName)
+	if operation == nil {
+		// Execution reports the missing operation.
+		return nil
+	}
+
+	w := &queryWalker{fragments: fragments, variables: variables}
+	depth, complexity := w.walk(operation.SelectionSet, nil, false)
+
+	if w.introspectionDepth > introspectionMaxDepth {
+		return fmt.Errorf("introspection depth %d exceeds the limit of %d", w.introspectionDepth, introspectionMaxDepth)
+	}
+	if depth > l.maxDepth {
+		return fmt.Errorf("query depth %d exceeds the limit of %d", depth, l.maxDepth)
+	}
+	if complexity > l.maxComplexity {
+		return fmt.Errorf("query complexity %d exceeds the limit of %d", complexity, l.maxComplexity)
+	}
+
+	return nil
+}
+
+// graphqlOperation returns the operation of doc that a request with
+// operationName runs, or nil if there is none.
+func graphqlOperation(doc *ast.Document, operationName string) *ast.OperationDefinition {
+	var operation *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		if def, ok := def.(*ast.OperationDefinition); ok {
+			if operationName == "" || (def.Name != nil && def.Name.Value == operationName) {
+				operation = def
+			}
+		}
+	}
+	return operation
+}
+
+type queryWalker struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]any
+	// introspectionDepth is the depth of the deepest introspection field,
+	// which is left out of the depth returned by walk.
+	introspectionDepth int
+}
+
+// walk returns the depth and complexity of a selection set. visiting holds
+// the fragments being expanded, so that cycles do not recurse forever, and
+// introspection tells whether set is below an introspection field.
+func (w *queryWalker) walk(set *ast.SelectionSet, visiting []string, introspection bool) (depth, complexity int) {
+	if set == nil {
+		return 0, 0
+	}
+
+	for _, selection := range set.Selections {
+		var d, c int
+
+		switch selection := selection.(type) {
+		case *ast.Field:
+			starts := !introspection && strings.HasPrefix(selection.Name.Value, "__")
+
+			d, c = w.walk(selection.SelectionSet, visiting, introspection || starts)
+			d, c = d+1, 1+w.multiplier(selection)*c
+
+			if starts {
+				w.introspectionDepth = max(w.introspectionDepth, d)
+				d = 0
+			}
+		case *ast.InlineFragment:
+			d, c = w.walk(selection.SelectionSet, visiting, introspection)
+		case *ast.FragmentSpread:
+			name := selection.Name.Value
+			fragment, ok := w.fragments[name]
+			if !ok || slices.Contains(visiting, name) {
+				continue
+			}
+			d, c = w.walk(fragment.SelectionSet, append(visiting, name), introspection)
+		}
+
+		depth = max(depth, d)
+		complexity += c
+	}
+
+	return depth, complexity
+}
+
+// multiplier returns the first argument of a field. A variable without a
+// value counts as the largest page and subscriptions without the argument as
+// the default one; other fields count once.
+func (w *queryWalker) multiplier(field *ast.Field) int {
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "first" {
+			continue
+		}
+
+		switch value := arg.Value.(type) {
+		case *ast.IntValue:
+			n, err := strconv.Atoi(value.Value)
+			if err == nil && n > 0 {
+				return n
+			}
+		case *ast.Variable:
+			switch n := w.variables[value.Name.Value].(type) {
+			case float64:
+				if n > 0 {
+					return int(n)
+				}
+			case int:
+				if n > 0 {
+					return n
+				}
+			case nil:
+				return graphqlMaxFirst
+			}
+		}
+
+		// Invalid values are rejected when the field resolves.
+		return 1
+	}
+
+	if field.Name.Value == "subscriptions" {
+		return graphqlDefaultFirst
+	}
+
+	return 1
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/testutil"
+)
+
+func TestQueryLimits(t *testing.T) {
+	defaults := queryLimits{maxDepth: 8, maxComplexity: 1000}
+
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]any
+		limits    queryLimits
+		wantErr   string
+	}{
+		{
+			name:   "Within limits",
+			query:  `{ subscriptions(first: 5) { edges { node { id service { name } } } } }`,
+			limits: defaults,
+		},
+		{
+			name:    "Depth",
+			query:   `{ subscriptions(first: 5) { edges { node { id service { name } } } } }`,
+			limits:  queryLimits{maxDepth: 4, maxComplexity: 1000},
+			wantErr: "query depth 5 exceeds the limit of 4",
+		},
+		{
+			name:    "Complexity multiplied by first",
+			query:   `{ subscriptions(first: 5) { edges { node { id service { name } } } } }`,
+			limits:  queryLimits{maxDepth: 8, maxComplexity: 25},
+			wantErr: "query complexity 26 exceeds the limit of 25",
+		},
+		{
+			name:    "Default page",
+			query:   `{ subscriptions { edges { cursor } } }`,
+			limits:  queryLimits{maxDepth: 8, maxComplexity: 40},
+			wantErr: "query complexity 41 exceeds the limit of 40",
+		},
+		{
+			name:      "Page from variable",
+			query:     `query($n: Int) { subscriptions(first: $n) { edges { cursor } } }`,
+			variables: map[string]any{"n": float64(3)},
+			limits:    queryLimits{maxDepth: 8, maxComplexity: 6},
+			wantErr:   "query complexity 7 exceeds the limit of 6",
+		},
+		{
+			name:    "Missing variable counts as the largest page",
+			query:   `query($n: Int) { subscriptions(first: $n) { edges { cursor } } }`,
+			limits:  queryLimits{maxDepth: 8, maxComplexity: 200},
+			wantErr: "query complexity 201 exceeds the limit of 200",
+		},
+		{
+			name:    "Fragments",
+			query:   `{ subscriptions(first: 2) { ...page } } fragment page on UserSubscriptionConnection { edges { cursor } pageInfo { hasNextPage } }`,
+			limits:  queryLimits{maxDepth: 8, maxComplexity: 8},
+			wantErr: "query complexity 9 exceeds the limit of 8",
+		},
+		{
+			name:   "Fragment cycle",
+			query:  `{ subscriptions { ...a } } fragment a on UserSubscriptionConnection { ...a pageInfo { hasNextPage } }`,
+			limits: defaults,
+		},
+		{
+			name:   "Introspection query",
+			query:  testutil.IntrospectionQuery,
+			limits: defaults,
+		},
+		{
+			name:    "Introspection complexity",
+			query:   `{ __schema { types { name } } }`,
+			limits:  queryLimits{maxDepth: 8, maxComplexity: 2},
+			wantErr: "query complexity 3 exceeds the limit of 2",
+		},
+		{
+			name:    "Introspection depth",
+			query:   `{ __schema { types { fields { type { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { name } } } } } } } } } } } } } } } }`,
+			limits:  defaults,
+			wantErr: "introspection depth 16 exceeds the limit of 15",
+		},
+		{
+			name:    "Typename within introspection",
+			query:   `{ __schema { types { fields { type { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { __typename } } } } } } } } } } } } } } } }`,
+			limits:  defaults,
+			wantErr: "introspection depth 16 exceeds the limit of 15",
+		},
+	}
+
+	for _, tt := range tests {
+		doc, err := parser.Parse(parser.ParseParams{Source: tt.query})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		err = tt.limits.check(doc, "", tt.variables)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: got error %q; want none", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: got error %v; want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/edzh1/rest-effective-mobile/internal/ratelimit"
+)
+
+func TestGraphQLRequiresAuthentication(t *testing.T) {
+	app := newTestApplication(t)
+	app.authEnabled = true
+
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, newJSONRequest(t, http.MethodPost, "/graphql", `{"query": "{ __typename }"}`))
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+// Mutations are charged to the write budget and queries to the report
+// budget, whose single token each allows one request.
+func TestGraphQLRateLimitClass(t *testing.T) {
+	tests := []struct {
+		name  string
+		first string
+		then  string
+		want  int
+	}{
+		{name: "Mutation after mutation", first: `mutation { deleteSubscription(id: "1") }`, then: `mutation { deleteSubscription(id: "1") }`, want: http.StatusTooManyRequests},
+		{name: "Query after mutation", first: `mutation { deleteSubscription(id: "1") }`, then: `{ __typename }`, want: http.StatusOK},
+		{name: "Mutation after query", first: `{ __typename }`, then: `mutation { deleteSubscription(id: "1") }`, want: http.StatusOK},
+		{name: "Query after query", first: `{ __typename }`, then: `{ __typename }`, want: http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		app := newTestApplication(t)
+		app.graphqlLimits = queryLimits{maxDepth: 8, maxComplexity: 1000}
+		app.rateLimiter = ratelimit.NewMemoryStore()
+		app.rateLimits = map[string]ratelimit.Limit{
+			rateLimitWrite:  {Rate: 0.001, Burst: 1},
+			rateLimitReport: {Rate: 0.001, Burst: 1},
+		}
+
+		var err error
+		app.graphqlSchema, err = app.newGraphQLSchema()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var status int
+		for _, query := range []string{tt.first, tt.then} {
+			body, err := json.Marshal(map[string]string{"query": query})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			app.routes().ServeHTTP(rr, newJSONRequest(t, http.MethodPost, "/graphql", string(body)))
+			status = rr.Code
+		}
+
+		if status != tt.want {
+			t.Errorf("%s: got status %d; want %d", tt.name, status, tt.want)
+		}
+	}
+}
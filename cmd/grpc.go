@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	subscriptionsv1 "github.com/edzh1/rest-effective-mobile/api/subscriptions/v1"
+	"github.com/edzh1/rest-effective-mobile/internal/config"
+	"github.com/edzh1/rest-effective-mobile/internal/models"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// grpcMethod is what the REST routes express with their middleware chain.
+type grpcMethod struct {
+	scope     string
+	rateLimit string
+	write     bool
+}
+
+var grpcMethods = map[string]grpcMethod{
+	subscriptionsv1.SubscriptionService_Get_FullMethodName:    {models.ScopeSubscriptionsRead, rateLimitRead, false},
+	subscriptionsv1.SubscriptionService_List_FullMethodName:   {models.ScopeSubscriptionsRead, rateLimitRead, false},
+	subscriptionsv1.SubscriptionService_Create_FullMethodName: {models.ScopeSubscriptionsWrite, rateLimitWrite, true},
+	subscriptionsv1.SubscriptionService_Update_FullMethodName: {models.ScopeSubscriptionsWrite, rateLimitWrite, true},
+	subscriptionsv1.SubscriptionService_Delete_FullMethodName: {models.ScopeSubscriptionsWrite, rateLimitWrite, true},
+	subscriptionsv1.SubscriptionService_Total_FullMethodName:  {models.ScopeReportsRead, rateLimitReport, false},
+}
+
+// newGRPCServer returns the gRPC API together with its health service, which
+// reports serving until it is shut down.
+func (app *application) newGRPCServer(cfg config.GRPC) (*grpc.Server, *health.Server) {
+	srv := grpc.NewServer(
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(app.unaryInterceptor),
+		grpc.ChainStreamInterceptor(app.streamInterceptor),
+	)
+
+	subscriptionsv1.RegisterSubscriptionServiceServer(srv, &subscriptionService{app: app})
+
+	healthSrv := health.NewServer()
+	healthSrv.SetServingStatus(subscriptionsv1.SubscriptionService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, healthSrv)
+
+	if cfg.Reflection {
+		reflection.Register(srv)
+	}
+
+	return srv, healthSrv
+}
+
+func (app *application) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	var resp any
+	err := app.intercept(ctx, info.FullMethod, func(ctx context.Context) error {
+		var err error
+		resp, err = handler(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (app *application) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return app.intercept(ss.Context(), info.FullMethod, func(ctx context.Context) error {
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	})
+}
+
+// serverStream replaces the context of a stream with the one prepared by the
+// interceptor.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// intercept does for a call what the standard REST chain does for a request:
+// it tags the logger with a request id, logs the call, recovers panics and,
+// for the subscription methods, authenticates the caller, resolves the
+// tenant, checks the scope and rate limit and routes reads.
+func (app *application) intercept(ctx context.Context, fullMethod string, call func(ctx context.Context) error) (err error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	id := firstMetadata(md, "x-request-id")
+	if !requestIDRX.MatchString(id) {
+		id = uuid.NewString()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+
+	logger := app.logger.With("request_id", id)
+	ctx = context.WithValue(ctx, loggerContextKey, logger)
+
+	var (
+		ip    = peerIP(ctx)
+		start = time.Now()
+	)
+
+	logger.InfoContext(ctx, "received request", "ip", ip, "proto", "gRPC", "method", fullMethod)
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = app.grpcError(ctx, fullMethod, fmt.Errorf("%s", p))
+		}
+
+		logger.InfoContext(ctx, "completed request", "method", fullMethod, "code", status.Code(err).String(), "duration", time.Since(start))
+	}()
+
+	method, ok := grpcMethods[fullMethod]
+	if !ok {
+		// Health and reflection are open to everyone, like the probes.
+		return call(ctx)
+	}
+
+	ctx, err = app.authorizeGRPC(ctx, md, method, ip)
+	if err != nil {
+		return err
+	}
+
+	client := callerID(ctx, ip)
+
+	primary, _ := strconv.ParseBool(firstMetadata(md, "x-read-primary"))
+	if primary || app.sticky.active(client) {
+		ctx = models.WithPrimary(ctx)
+	}
+
+	err = call(ctx)
+	if method.write && err == nil {
+		app.sticky.wrote(client)
+	}
+
+	return err
+}
+
+// authorizeGRPC authenticates the caller, resolves the tenant and checks the
+// scope and rate limit of method.
+func (app *application) authorizeGRPC(ctx context.Context, md metadata.MD, method grpcMethod, ip string) (context.Context, error) {
+	ctx, err := app.identify(ctx, firstMetadata(md, "x-api-key"), firstMetadata(md, "authorization"))
+	switch {
+	case errors.Is(err, errInvalidAPIKey):
+		return ctx, status.Error(codes.Unauthenticated, "Invalid API key")
+	case errors.Is(err, errInvalidToken):
+		return ctx, status.Error(codes.Unauthenticated, "Invalid token")
+	case err != nil:
+		return ctx, app.grpcError(ctx, "authenticate", err)
+	}
+
+	ctx, err = app.withTenant(ctx, firstMetadata(md, "x-tenant-id"))
+	switch {
+	case errors.Is(err, errInvalidTenant):
+		return ctx, status.Error(codes.InvalidArgument, "Invalid x-tenant-id format")
+	case errors.Is(err, errForbidden):
+		return ctx, status.Error(codes.PermissionDenied, "Forbidden")
+	}
+
+	switch app.checkScope(ctx, method.scope) {
+	case errUnauthenticated:
+		return ctx, status.Error(codes.Unauthenticated, "Unauthorized")
+	case errForbidden:
+		return ctx, status.Error(codes.PermissionDenied, "Forbidden")
+	}
+
+	limit, ok := app.rateLimits[method.rateLimit]
+	if !ok {
+		return ctx, nil
+	}
+
+	res, err := app.rateLimiter.Take(ctx, method.rateLimit+"/"+callerID(ctx, ip), limit)
+	if err != nil {
+		app.loggerFrom(ctx).ErrorContext(ctx, "rate limit store failed", "error", err.Error())
+		return ctx, nil
+	}
+
+	if !res.Allowed {
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(ceilSeconds(res.RetryAfter))))
+		return ctx, status.Error(codes.ResourceExhausted, "Too Many Requests")
+	}
+
+	return ctx, nil
+}
+
+// grpcError logs err and turns it into a status the same way serverError
+// turns it into an HTTP response.
+func (app *application) grpcError(ctx context.Context, method string, err error) error {
+	logger := app.loggerFrom(ctx)
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		logger.InfoContext(ctx, "request canceled", "method", method)
+		return status.Error(codes.Canceled, "Canceled")
+	case errors.Is(err, models.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		logger.ErrorContext(ctx, err.Error(), "method", method)
+		return status.Error(codes.DeadlineExceeded, "Gateway Timeout")
+	case errors.Is(err, models.ErrUnavailable):
+		logger.ErrorContext(ctx, err.Error(), "method", method)
+		return status.Error(codes.Unavailable, "Service Unavailable")
+	}
+
+	logger.ErrorContext(ctx, err.Error(), "method", method, "trace", string(debug.Stack()))
+	return status.Error(codes.Internal, "Internal Server Error")
+}
+
+func firstMetadata(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// subscriptionService implements SubscriptionService with the validation of
+// the REST handlers.
+type subscriptionService struct {
+	subscriptionsv1.UnimplementedSubscriptionServiceServer
+	app *application
+}
+
+func (s *subscriptionService) Get(ctx context.Context, req *subscriptionsv1.GetRequest) (*subscriptionsv1.GetResponse, error) {
+	id, err := uuid.Parse(req.GetId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid UUID format")
+	}
+
+	subscription, err := s.app.subscriptionsFor(ctx).Get(ctx, id, ownerIDFrom(ctx))
+	if err != nil {
+		return nil, s.modelError(ctx, "Get", err)
+	}
+
+	return &subscriptionsv1.GetResponse{Subscription: subscriptionToProto(subscription)}, nil
+}
+
+func (s *subscriptionService) List(req *subscriptionsv1.ListRequest, stream grpc.ServerStreamingServer[subscriptionsv1.ListResponse]) error {
+	ctx := stream.Context()
+
+	filter, err := readFilter(req.GetFilter(), ownerIDFrom(ctx))
+	if err != nil {
+		return err
+	}
+
+	err = s.app.subscriptionsFor(ctx).Stream(ctx, filter, func(subscription models.Subscription) error {
+		return stream.Send(&subscriptionsv1.ListResponse{Subscription: subscriptionToProto(subscription)})
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			// Send failed, the client has gone away.
+			return err
+		}
+		return s.modelError(ctx, "List", err)
+	}
+
+	return nil
+}
+
+func (s *subscriptionService) Create(ctx context.Context, req *subscriptionsv1.CreateRequest) (*subscriptionsv1.CreateResponse, error) {
+	body := subscriptionCreateBody{
+		UserID:      req.GetUserId(),
+		ServiceName: req.GetServiceName(),
+		Price:       int(req.GetPrice()),
+		StartDate:   req.GetStartDate(),
+		EndDate:     req.GetEndDate(),
+	}
+
+	subscription, err := s.validate(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+
+	id, overlapping, err := s.app.subscriptionsFor(ctx).Insert(ctx, subscription.UserID.String(), subscription.ServiceName, subscription.Price, subscription.StartDate, subscription.EndDate)
+	if err != nil {
+		return nil, s.writeError(ctx, "Create", err)
+	}
+	s.warnOverlaps(ctx, subscription, overlapping)
+
+	return &subscriptionsv1.CreateResponse{Id: id.String()}, nil
+}
+
+func (s *subscriptionService) Update(ctx context.Context, req *subscriptionsv1.UpdateRequest) (*subscriptionsv1.UpdateResponse, error) {
+	id, err := uuid.Parse(req.GetId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid UUID format")
+	}
+
+	body := subscriptionCreateBody{
+		UserID:      req.GetUserId(),
+		ServiceName: req.GetServiceName(),
+		Price:       int(req.GetPrice()),
+		StartDate:   req.GetStartDate(),
+		EndDate:     req.GetEndDate(),
+	}
+
+	subscription, err := s.validate(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+
+	_, overlapping, err := s.app.subscriptionsFor(ctx).Update(ctx, id, ownerIDFrom(ctx), subscription.UserID.String(), subscription.ServiceName, subscription.Price, subscription.StartDate, subscription.EndDate)
+	if err != nil {
+		return nil, s.writeError(ctx, "Update", err)
+	}
+	s.warnOverlaps(ctx, subscription, overlapping)
+
+	return &subscriptionsv1.UpdateResponse{Id: id.String()}, nil
+}
+
+func (s *subscriptionService) Delete(ctx context.Context, req *subscriptionsv1.DeleteRequest) (*subscriptionsv1.DeleteResponse, error) {
+	id, err := uuid.Parse(req.GetId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid UUID format")
+	}
+
+	err = s.app.subscriptionsFor(ctx).Delete(ctx, id, ownerIDFrom(ctx))
+	if err != nil {
+		return nil, s.modelError(ctx, "Delete", err)
+	}
+
+	return &subscriptionsv1.DeleteResponse{}, nil
+}
+
+func (s *subscriptionService) Total(ctx context.Context, req *subscriptionsv1.TotalRequest) (*subscriptionsv1.TotalResponse, error) {
+	filter, err := readFilter(req.GetFilter(), ownerIDFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := s.app.subscriptionsFor(ctx).CountTotal(ctx, filter)
+	if err != nil {
+		return nil, s.modelError(ctx, "Total", err)
+	}
+
+	return &subscriptionsv1.TotalResponse{Total: int64(total)}, nil
+}
+
+// validate checks a subscription sent for Create or Update with
+// prepareSubscription.
+func (s *subscriptionService) validate(ctx context.Context, body subscriptionCreateBody) (models.Subscription, error) {
+	subscription, err := s.app.prepareSubscription(ctx, body)
+
+	var inputErr inputError
+	switch {
+	case errors.As(err, &inputErr):
+		return subscription, status.Error(codes.InvalidArgument, inputErr.message)
+	case errors.Is(err, errForbidden):
+		return subscription, status.Error(codes.PermissionDenied, "Forbidden")
+	}
+
+	return subscription, nil
+}
+
+// warnOverlaps reports the overlaps of a written subscription, which the
+// warn policy let through, in the warning header.
+func (s *subscriptionService) warnOverlaps(ctx context.Context, subscription models.Subscription, overlapping []models.Subscription) {
+	if warning := s.app.overlapWarning(ctx, subscription, overlapping); warning != "" {
+		grpc.SetHeader(ctx, metadata.Pairs("warning", fmt.Sprintf("299 - %q", warning)))
+	}
+}
+
+// modelError maps ErrNoRecord to NotFound and everything else the way
+// grpcError does.
+func (s *subscriptionService) modelError(ctx context.Context, method string, err error) error {
+	if errors.Is(err, models.ErrNoRecord) {
+		return status.Error(codes.NotFound, "Not Found")
+	}
+	return s.app.grpcError(ctx, method, err)
+}
+
+// writeError treats failures of Insert and Update other than overlaps and
+// those of the database as invalid input, like the REST handlers do.
+func (s *subscriptionService) writeError(ctx context.Context, method string, err error) error {
+	var overlapErr *models.OverlapError
+	if errors.As(err, &overlapErr) {
+		return status.Error(codes.AlreadyExists, overlapMessage(overlapErr.Subscriptions))
+	}
+	if errors.Is(err, models.ErrNoRecord) || isDatabaseFailure(err) {
+		return s.modelError(ctx, method, err)
+	}
+	return status.Error(codes.InvalidArgument, "Bad Request")
+}
+
+// readFilter validates f with the rules of the REST query parameters and
+// limits it to ownerID.
+func readFilter(f *subscriptionsv1.Filter, ownerID *uuid.UUID) (models.SubscriptionFilter, error) {
+	query := filterQuery(f.GetUserId(), f.GetServiceName(), f.GetStartDate(), f.GetEndDate())
+
+	filter, err := readSubscriptionFilter(query)
+	if err != nil {
+		return filter, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if !restrictFilter(&filter, ownerID) {
+		return filter, status.Error(codes.PermissionDenied, "Forbidden")
+	}
+
+	return filter, nil
+}
+
+func subscriptionToProto(s models.Subscription) *subscriptionsv1.Subscription {
+	out := &subscriptionsv1.Subscription{
+		Id:          s.ID.String(),
+		UserId:      s.UserID.String(),
+		ServiceName: s.ServiceName,
+		Price:       int64(s.Price),
+		StartDate:   s.StartDate.Format(time.DateOnly),
+	}
+	if s.EndDate != nil {
+		out.EndDate = s.EndDate.Format(time.DateOnly)
+	}
+	return out
+}
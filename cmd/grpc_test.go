@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	subscriptionsv1 "github.com/edzh1/rest-effective-mobile/api/subscriptions/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// REST and gRPC reject the same subscriptions with the same messages.
+func TestCreateValidationMatchesREST(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *subscriptionsv1.CreateRequest
+		body string
+	}{
+		{
+			name: "End before start",
+			req:  &subscriptionsv1.CreateRequest{UserId: "60601fee-2bf1-4721-ae6f-7636e79a0cba", ServiceName: "Yandex Plus", Price: 400, StartDate: "2025-07-01", EndDate: "2025-06-01"},
+			body: `{"user_id":"60601fee-2bf1-4721-ae6f-7636e79a0cba","service_name":"Yandex Plus","price":400,"start_date":"2025-07-01","end_date":"2025-06-01"}`,
+		},
+		{
+			name: "Negative price",
+			req:  &subscriptionsv1.CreateRequest{UserId: "60601fee-2bf1-4721-ae6f-7636e79a0cba", ServiceName: "Yandex Plus", Price: -1, StartDate: "2025-07-01"},
+			body: `{"user_id":"60601fee-2bf1-4721-ae6f-7636e79a0cba","service_name":"Yandex Plus","price":-1,"start_date":"2025-07-01"}`,
+		},
+		{
+			name: "Empty service name",
+			req:  &subscriptionsv1.CreateRequest{UserId: "60601fee-2bf1-4721-ae6f-7636e79a0cba", Price: 400, StartDate: "2025-07-01"},
+			body: `{"user_id":"60601fee-2bf1-4721-ae6f-7636e79a0cba","service_name":"","price":400,"start_date":"2025-07-01"}`,
+		},
+	}
+
+	app := newTestApplication(t)
+	srv := &subscriptionService{app: app}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := srv.Create(context.Background(), tt.req)
+			st := status.Convert(err)
+			if st.Code() != codes.InvalidArgument {
+				t.Fatalf("got gRPC code %s; want %s", st.Code(), codes.InvalidArgument)
+			}
+
+			rr := httptest.NewRecorder()
+			app.subscriptionCreate(rr, newJSONRequest(t, http.MethodPost, "/v1/subscriptions", tt.body))
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d; want %d", rr.Code, http.StatusBadRequest)
+			}
+			if got := strings.TrimSpace(rr.Body.String()); got != st.Message() {
+				t.Errorf("got REST message %q; want the gRPC one %q", got, st.Message())
+			}
+		})
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/edzh1/rest-effective-mobile/internal/models"
@@ -20,6 +26,50 @@ type subscriptionCreateBody struct {
 	EndDate     string `json:"end_date,omitempty" example:""`
 }
 
+func (b subscriptionCreateBody) validate() (models.Subscription, error) {
+	userID, err := uuid.Parse(b.UserID)
+	if err != nil {
+		return models.Subscription{}, errors.New("invalid user_id")
+	}
+
+	if b.ServiceName == "" {
+		return models.Subscription{}, errors.New("service_name is required")
+	}
+
+	if len(b.ServiceName) > 255 {
+		return models.Subscription{}, errors.New("service_name is too long")
+	}
+
+	if b.Price < 0 {
+		return models.Subscription{}, errors.New("price must not be negative")
+	}
+
+	startDate, err := time.Parse("2006-01-02", b.StartDate)
+	if err != nil {
+		return models.Subscription{}, errors.New("invalid start_date")
+	}
+
+	var endDate *time.Time
+	if b.EndDate != "" {
+		t, err := time.Parse("2006-01-02", b.EndDate)
+		if err != nil {
+			return models.Subscription{}, errors.New("invalid end_date")
+		}
+		if t.Before(startDate) {
+			return models.Subscription{}, errors.New("end_date is before start_date")
+		}
+		endDate = &t
+	}
+
+	return models.Subscription{
+		UserID:      userID,
+		ServiceName: b.ServiceName,
+		Price:       b.Price,
+		StartDate:   startDate,
+		EndDate:     endDate,
+	}, nil
+}
+
 type subscriptionUpdateBody struct {
 	subscriptionCreateBody
 }
@@ -32,17 +82,149 @@ type TotalResponse struct {
 	Total int `json:"total" example:"100500"`
 }
 
+func (t TotalResponse) csvHeader() []string {
+	return []string{"total"}
+}
+
+func (t TotalResponse) csvRecords() [][]string {
+	return [][]string{{strconv.Itoa(t.Total)}}
+}
+
+func (t TotalResponse) ndjsonValues() []any {
+	return []any{t}
+}
+
+type SubscriptionResponse struct {
+	Subscription models.Subscription `json:"subscription"`
+}
+
+func (s SubscriptionResponse) csvHeader() []string {
+	return subscriptionCSVHeader
+}
+
+func (s SubscriptionResponse) csvRecords() [][]string {
+	return [][]string{subscriptionCSVRecord(s.Subscription)}
+}
+
+func (s SubscriptionResponse) ndjsonValues() []any {
+	return []any{s.Subscription}
+}
+
+type SubscriptionListResponse struct {
+	Subscriptions []models.Subscription `json:"subscriptions"`
+}
+
+func (l SubscriptionListResponse) csvHeader() []string {
+	return subscriptionCSVHeader
+}
+
+func (l SubscriptionListResponse) csvRecords() [][]string {
+	records := make([][]string, 0, len(l.Subscriptions))
+	for _, s := range l.Subscriptions {
+		records = append(records, subscriptionCSVRecord(s))
+	}
+	return records
+}
+
+func (l SubscriptionListResponse) ndjsonValues() []any {
+	values := make([]any, 0, len(l.Subscriptions))
+	for _, s := range l.Subscriptions {
+		values = append(values, s)
+	}
+	return values
+}
+
+type apiKeyCreateBody struct {
+	Name      string   `json:"name" example:"reporting"`
+	Scopes    []string `json:"scopes" example:"subscriptions:read,reports:read"`
+	ExpiresAt string   `json:"expires_at,omitempty" example:"2026-01-01T00:00:00Z"`
+}
+
+type APIKeyCreateResponse struct {
+	APIKey models.APIKey `json:"api_key"`
+	Key    string        `json:"key" example:"sk_3f1c..."`
+}
+
+type APIKeyListResponse struct {
+	APIKeys []models.APIKey `json:"api_keys"`
+}
+
+type OverlapListResponse struct {
+	Overlaps []models.Overlap `json:"overlaps"`
+}
+
+// csvHeader repeats the subscription columns for the subscription it
+// conflicts with, prefixed with conflicts_with_.
+func (l OverlapListResponse) csvHeader() []string {
+	header := slices.Clone(subscriptionCSVHeader)
+	for _, column := range subscriptionCSVHeader {
+		header = append(header, "conflicts_with_"+column)
+	}
+	return header
+}
+
+func (l OverlapListResponse) csvRecords() [][]string {
+	records := make([][]string, 0, len(l.Overlaps))
+	for _, o := range l.Overlaps {
+		records = append(records, append(subscriptionCSVRecord(o.Subscription), subscriptionCSVRecord(o.ConflictsWith)...))
+	}
+	return records
+}
+
+func (l OverlapListResponse) ndjsonValues() []any {
+	values := make([]any, 0, len(l.Overlaps))
+	for _, o := range l.Overlaps {
+		values = append(values, o)
+	}
+	return values
+}
+
+type HealthResponse struct {
+	Status string `json:"status" example:"ok"`
+}
+
+type ReadinessResponse struct {
+	Status string            `json:"status" example:"ok"`
+	Checks map[string]string `json:"checks"`
+}
+
+type ImportLineError struct {
+	Line  int    `json:"line" example:"3"`
+	Error string `json:"error" example:"invalid start_date"`
+}
+
+type ImportResponse struct {
+	DryRun   bool              `json:"dry_run"`
+	Rows     int               `json:"rows" example:"10"`
+	Inserted int               `json:"inserted" example:"8"`
+	Updated  int               `json:"updated" example:"0"`
+	Skipped  int               `json:"skipped" example:"2"`
+	Errors   []ImportLineError `json:"errors,omitempty"`
+}
+
 // subscriptionView godoc
 // @Summary Get subscription by ID
 // @Description Get a single subscription by its ID
 // @Tags subscriptions
 // @Accept json
 // @Produce json
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param X-Tenant-ID header string false "Tenant ID, must match the credentials if given"
+// @Param X-Read-Primary header bool false "Read from the primary database instead of a replica"
 // @Param id path string true "Subscription ID" Format(uuid)
-// @Success 200 {object} models.Subscription
+// @Success 200 {object} SubscriptionResponse
 // @Failure 400 {string} string "Invalid UUID format"
 // @Failure 404 {string} string "404 page not found"
-// @Router /subscriptions/{id} [get]
+// @Failure 406 {string} string "Not Acceptable"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 429 {string} string "Too Many Requests"
+// @Failure 503 {string} string "Service Unavailable"
+// @Failure 504 {string} string "Gateway Timeout"
+// @Router /v1/subscriptions/{id} [get]
 func (app *application) subscriptionView(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(r.PathValue("id"))
 	if err != nil {
@@ -50,7 +232,7 @@ func (app *application) subscriptionView(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	subscription, err := app.subscriptions.Get(id)
+	subscription, err := app.tenantSubscriptions(r).Get(r.Context(), id, app.ownerID(r))
 
 	if err != nil {
 		if errors.Is(err, models.ErrNoRecord) {
@@ -61,20 +243,11 @@ func (app *application) subscriptionView(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	data := struct {
-		Subscription models.Subscription `json:"subscription"`
-	}{
+	data := SubscriptionResponse{
 		Subscription: subscription,
 	}
 
-	jsonBytes, err := json.Marshal(data)
-	if err != nil {
-		app.serverError(w, r, err)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonBytes)
+	app.writeResponse(w, r, http.StatusOK, data)
 }
 
 // subscriptionViewList godoc
@@ -83,59 +256,54 @@ func (app *application) subscriptionView(w http.ResponseWriter, r *http.Request)
 // @Tags subscriptions
 // @Accept json
 // @Produce json
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param X-Tenant-ID header string false "Tenant ID, must match the credentials if given"
+// @Param X-Read-Primary header bool false "Read from the primary database instead of a replica"
 // @Param user_id query string false "User ID filter" Format(uuid)
 // @Param service_name query string false "Service name filter"
 // @Param start_date query string false "Start date filter (YYYY-MM-DD)" Format(date)
 // @Param end_date query string false "End date filter (YYYY-MM-DD)" Format(date)
 // @Param page query int false "Page number" minimum(1) maximum(100)
-// @Success 200 {object} []models.Subscription
+// @Success 200 {object} SubscriptionListResponse
 // @Failure 400 {string} string "Invalid parameter format"
-// @Router /subscriptions [get]
+// @Failure 406 {string} string "Not Acceptable"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 429 {string} string "Too Many Requests"
+// @Failure 503 {string} string "Service Unavailable"
+// @Failure 504 {string} string "Gateway Timeout"
+// @Router /v1/subscriptions [get]
 func (app *application) subscriptionViewList(w http.ResponseWriter, r *http.Request) {
-	var filter models.SubscriptionFilter
 	query := r.URL.Query()
 
-	if userIDStr := query.Get("user_id"); userIDStr != "" {
-		userID, err := uuid.Parse(userIDStr)
-		if err != nil {
-			http.Error(w, "Invalid user_id format", http.StatusBadRequest)
-			return
-		}
-		filter.UserID = &userID
-	}
-
-	if serviceName := query.Get("service_name"); serviceName != "" {
-		filter.ServiceName = &serviceName
-	}
-
-	if startDateStr := query.Get("start_date"); startDateStr != "" {
-		startDate, err := time.Parse("2006-01-02", startDateStr)
-		if err != nil {
-			http.Error(w, "Invalid start_date format", http.StatusBadRequest)
-			return
-		}
-		filter.StartDate = &startDate
+	filter, err := readSubscriptionFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if endDateStr := query.Get("end_date"); endDateStr != "" {
-		endDate, err := time.Parse("2006-01-02", endDateStr)
-		if err != nil {
-			http.Error(w, "Invalid end_date format", http.StatusBadRequest)
-			return
-		}
-		filter.EndDate = &endDate
+	if !restrictFilter(&filter, app.ownerID(r)) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
 	}
 
 	if pageStr := query.Get("page"); pageStr != "" {
 		page, err := strconv.Atoi(pageStr)
-		if err != nil || page == 0 {
+		if err != nil || page < 1 {
 			http.Error(w, "Invalid page format", http.StatusBadRequest)
 			return
 		}
+		if page > app.maxPage {
+			http.Error(w, fmt.Sprintf("page must not exceed %d", app.maxPage), http.StatusBadRequest)
+			return
+		}
 		filter.Page = &page
 	}
 
-	subscriptions, err := app.subscriptions.List(filter)
+	subscriptions, err := app.tenantSubscriptions(r).List(r.Context(), filter)
 	if err != nil {
 		if errors.Is(err, models.ErrNoRecord) {
 			http.NotFound(w, r)
@@ -145,20 +313,11 @@ func (app *application) subscriptionViewList(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	data := struct {
-		Subscriptions []models.Subscription `json:"subscriptions"`
-	}{
+	data := SubscriptionListResponse{
 		Subscriptions: subscriptions,
 	}
 
-	jsonBytes, err := json.Marshal(data)
-	if err != nil {
-		app.serverError(w, r, err)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonBytes)
+	app.writeResponse(w, r, http.StatusOK, data)
 }
 
 // subscriptionTotal godoc
@@ -167,49 +326,42 @@ func (app *application) subscriptionViewList(w http.ResponseWriter, r *http.Requ
 // @Tags subscriptions
 // @Accept json
 // @Produce json
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param X-Tenant-ID header string false "Tenant ID, must match the credentials if given"
+// @Param X-Read-Primary header bool false "Read from the primary database instead of a replica"
 // @Param user_id query string false "User ID filter" Format(uuid)
 // @Param service_name query string false "Service name filter"
 // @Param start_date query string false "Period start (YYYY-MM-DD)" Format(date)
 // @Param end_date query string false "Period end (YYYY-MM-DD)" Format(date)
+// @Param If-None-Match header string false "ETag of a previously received response"
 // @Success 200 {object} TotalResponse
+// @Success 304 {string} string "Not Modified"
 // @Failure 400 {string} string "Invalid parameter format"
-// @Router /subscriptions/total [get]
+// @Failure 406 {string} string "Not Acceptable"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 429 {string} string "Too Many Requests"
+// @Failure 503 {string} string "Service Unavailable"
+// @Failure 504 {string} string "Gateway Timeout"
+// @Router /v1/subscriptions/total [get]
 func (app *application) subscriptionTotal(w http.ResponseWriter, r *http.Request) {
-	var filter models.SubscriptionFilter
 	query := r.URL.Query()
 
-	if userIDStr := query.Get("user_id"); userIDStr != "" {
-		userID, err := uuid.Parse(userIDStr)
-		if err != nil {
-			http.Error(w, "Invalid user_id format", http.StatusBadRequest)
-			return
-		}
-		filter.UserID = &userID
-	}
-
-	if serviceName := query.Get("service_name"); serviceName != "" {
-		filter.ServiceName = &serviceName
-	}
-
-	if startDateStr := query.Get("start_date"); startDateStr != "" {
-		startDate, err := time.Parse("2006-01-02", startDateStr)
-		if err != nil {
-			http.Error(w, "Invalid start_date format", http.StatusBadRequest)
-			return
-		}
-		filter.StartDate = &startDate
+	filter, err := readSubscriptionFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if endDateStr := query.Get("end_date"); endDateStr != "" {
-		endDate, err := time.Parse("2006-01-02", endDateStr)
-		if err != nil {
-			http.Error(w, "Invalid end_date format", http.StatusBadRequest)
-			return
-		}
-		filter.EndDate = &endDate
+	if !restrictFilter(&filter, app.ownerID(r)) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
 	}
 
-	total, err := app.subscriptions.CountTotal(filter)
+	total, err := app.tenantSubscriptions(r).CountTotal(r.Context(), filter)
 	if err != nil {
 		if errors.Is(err, models.ErrNoRecord) {
 			http.NotFound(w, r)
@@ -219,84 +371,189 @@ func (app *application) subscriptionTotal(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	data := struct {
-		Total int `json:"total"`
-	}{
+	data := TotalResponse{
 		Total: total,
 	}
 
-	jsonBytes, err := json.Marshal(data)
-	if err != nil {
-		app.serverError(w, r, err)
+	if app.notModified(w, r, data) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonBytes)
+	app.writeResponse(w, r, http.StatusOK, data)
 }
 
-// subscriptionCreate godoc
-// @Summary Create new subscription
-// @Description Create a new subscription record
+// subscriptionExport godoc
+// @Summary Export subscriptions
+// @Description Stream all subscriptions matching the filters as a CSV or NDJSON download
 // @Tags subscriptions
-// @Accept json
-// @Produce json
-// @Param subscription body subscriptionCreateBody true "Subscription data"
-// @Success 200 {object} IDResponse "{"id": "a3509860-d66f-4be4-8984-0b7a15b8f10c"}"
-// @Failure 400 {string} string "Bad Request"
-// @Router /subscriptions [post]
-func (app *application) subscriptionCreate(w http.ResponseWriter, r *http.Request) {
-	reader := r.Body
-	defer reader.Close()
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param X-Tenant-ID header string false "Tenant ID, must match the credentials if given"
+// @Param format query string false "Export format" Enums(csv, ndjson) default(csv)
+// @Param user_id query string false "User ID filter" Format(uuid)
+// @Param service_name query string false "Service name filter"
+// @Param start_date query string false "Start date filter (YYYY-MM-DD)" Format(date)
+// @Param end_date query string false "End date filter (YYYY-MM-DD)" Format(date)
+// @Success 200 {file} file
+// @Failure 400 {string} string "Invalid parameter format"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 429 {string} string "Too Many Requests"
+// @Failure 503 {string} string "Service Unavailable"
+// @Failure 504 {string} string "Gateway Timeout"
+// @Router /v1/subscriptions/export [get]
+func (app *application) subscriptionExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
 
-	body, err := io.ReadAll(reader)
+	filter, err := readSubscriptionFilter(query)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var reqBody subscriptionCreateBody
-
-	err = json.Unmarshal(body, &reqBody)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	if !restrictFilter(&filter, app.ownerID(r)) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		return
 	}
 
-	startDate, err := time.Parse("2006-01-02", reqBody.StartDate)
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	err = app.extendWriteDeadline(w, app.exportTimeout)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		app.serverError(w, r, err)
 		return
 	}
 
-	var endDate *time.Time
-	if reqBody.EndDate != "" {
-		t, err := time.Parse("2006-01-02", reqBody.EndDate)
+	var (
+		write func(models.Subscription) error
+		flush func() error
+	)
+
+	switch format {
+	case "csv":
+		csvWriter := csv.NewWriter(w)
+		write = func(s models.Subscription) error {
+			return csvWriter.Write(subscriptionCSVRecord(s))
+		}
+		flush = func() error {
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="subscriptions.csv"`)
+
+		err = csvWriter.Write(subscriptionCSVHeader)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
-		endDate = &t
+	case "ndjson":
+		encoder := json.NewEncoder(w)
+		write = func(s models.Subscription) error {
+			return encoder.Encode(s)
+		}
+		flush = func() error {
+			return nil
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="subscriptions.ndjson"`)
+	default:
+		http.Error(w, "Invalid format value", http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	count := 0
+
+	err = app.tenantSubscriptions(r).Stream(r.Context(), filter, func(s models.Subscription) error {
+		err := write(s)
+		if err != nil {
+			return err
+		}
+
+		count++
+		if count%1000 == 0 {
+			err = flush()
+			if err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+
+		return nil
+	})
+	if err == nil {
+		err = flush()
 	}
 
-	id, err := app.subscriptions.Insert(reqBody.UserID, reqBody.ServiceName, reqBody.Price, startDate, endDate)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		if count == 0 {
+			w.Header().Del("Content-Disposition")
+			app.serverError(w, r, err)
+			return
+		}
+
+		// The status line has already been sent once rows start streaming, so
+		// the response is aborted: the connection is cut instead of ending the
+		// chunked body, and the client sees the file is incomplete.
+		app.requestLogger(r).ErrorContext(r.Context(), err.Error(), "method", r.Method, "uri", r.URL.RequestURI(), "rows", count)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// subscriptionCreate godoc
+// @Summary Create new subscription
+// @Description Create a new subscription record
+// @Tags subscriptions
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param X-Tenant-ID header string false "Tenant ID, must match the credentials if given"
+// @Param subscription body subscriptionCreateBody true "Subscription data"
+// @Param Idempotency-Key header string false "Unique key to safely retry the request"
+// @Success 200 {object} IDResponse "{"id": "a3509860-d66f-4be4-8984-0b7a15b8f10c"}"
+// @Failure 400 {string} string "Bad Request"
+// @Failure 413 {string} string "Request Entity Too Large"
+// @Failure 415 {string} string "Unsupported Media Type"
+// @Failure 409 {string} string "Subscription overlaps with an existing one, or request with this Idempotency-Key is in progress"
+// @Failure 422 {string} string "Idempotency-Key was used with a different request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 429 {string} string "Too Many Requests"
+// @Failure 503 {string} string "Service Unavailable"
+// @Failure 504 {string} string "Gateway Timeout"
+// @Router /v1/subscriptions [post]
+func (app *application) subscriptionCreate(w http.ResponseWriter, r *http.Request) {
+	var reqBody subscriptionCreateBody
+
+	if !app.readJSON(w, r, &reqBody) {
 		return
 	}
 
-	data := IDResponse{
-		ID: id,
+	subscription, ok := app.checkSubscription(w, r, reqBody)
+	if !ok {
+		return
 	}
 
-	jsonBytes, err := json.Marshal(data)
+	id, overlapping, err := app.tenantSubscriptions(r).Insert(r.Context(), subscription.UserID.String(), subscription.ServiceName, subscription.Price, subscription.StartDate, subscription.EndDate)
 	if err != nil {
-		app.serverError(w, r, err)
+		app.writeFailure(w, r, err)
 		return
 	}
+	app.warnOverlaps(w, r, subscription, overlapping)
+
+	data := IDResponse{
+		ID: id,
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonBytes)
+	app.writeJSON(w, r, http.StatusOK, data)
 }
 
 // subscriptionUpdate godoc
@@ -305,12 +562,25 @@ func (app *application) subscriptionCreate(w http.ResponseWriter, r *http.Reques
 // @Tags subscriptions
 // @Accept json
 // @Produce json
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param X-Tenant-ID header string false "Tenant ID, must match the credentials if given"
 // @Param id path string true "Subscription ID" Format(uuid)
 // @Param subscription body subscriptionUpdateBody true "Updated subscription data"
+// @Param Idempotency-Key header string false "Unique key to safely retry the request"
 // @Success 200 {object} IDResponse
 // @Failure 400 {string} string "Bad Request"
+// @Failure 413 {string} string "Request Entity Too Large"
+// @Failure 415 {string} string "Unsupported Media Type"
 // @Failure 404 {string} string "Not Found"
-// @Router /subscriptions/{id} [put]
+// @Failure 409 {string} string "Subscription overlaps with an existing one, or request with this Idempotency-Key is in progress"
+// @Failure 422 {string} string "Idempotency-Key was used with a different request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 429 {string} string "Too Many Requests"
+// @Failure 503 {string} string "Service Unavailable"
+// @Failure 504 {string} string "Gateway Timeout"
+// @Router /v1/subscriptions/{id} [put]
 func (app *application) subscriptionUpdate(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(r.PathValue("id"))
 	if err != nil {
@@ -318,78 +588,483 @@ func (app *application) subscriptionUpdate(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	var reqBody subscriptionUpdateBody
+
+	if !app.readJSON(w, r, &reqBody) {
+		return
+	}
+
+	subscription, ok := app.checkSubscription(w, r, reqBody.subscriptionCreateBody)
+	if !ok {
+		return
+	}
+
+	_, overlapping, err := app.tenantSubscriptions(r).Update(r.Context(), id, app.ownerID(r), subscription.UserID.String(), subscription.ServiceName, subscription.Price, subscription.StartDate, subscription.EndDate)
+	if err != nil {
+		app.writeFailure(w, r, err)
+		return
+	}
+	app.warnOverlaps(w, r, subscription, overlapping)
+
+	data := IDResponse{
+		ID: id,
+	}
+
+	app.writeJSON(w, r, http.StatusOK, data)
+}
+
+// subscriptionDelete godoc
+// @Summary Delete subscription
+// @Description Delete a subscription by ID
+// @Tags subscriptions
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param X-Tenant-ID header string false "Tenant ID, must match the credentials if given"
+// @Param id path string true "Subscription ID" Format(uuid)
+// @Param Idempotency-Key header string false "Unique key to safely retry the request"
+// @Success 200 {string} string "OK"
+// @Failure 400 {string} string "Invalid UUID format"
+// @Failure 404 {string} string "Not Found"
+// @Failure 409 {string} string "Request with this Idempotency-Key is in progress"
+// @Failure 422 {string} string "Idempotency-Key was used with a different request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 429 {string} string "Too Many Requests"
+// @Failure 503 {string} string "Service Unavailable"
+// @Failure 504 {string} string "Gateway Timeout"
+// @Router /v1/subscriptions/{id} [delete]
+func (app *application) subscriptionDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid UUID format", http.StatusBadRequest)
+		return
+	}
+
+	err = app.tenantSubscriptions(r).Delete(r.Context(), id, app.ownerID(r))
+
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			http.NotFound(w, r)
+		} else {
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// subscriptionImport godoc
+// @Summary Import subscriptions from CSV
+// @Description Import subscriptions from a CSV file with a header row of user_id, service_name, price, start_date and optional end_date columns.
+// @Description In dry-run mode every row is validated and the import is rolled back, so the report shows what would happen.
+// @Tags subscriptions
+// @Accept text/csv
+// @Produce json
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param X-Tenant-ID header string false "Tenant ID, must match the credentials if given"
+// @Param dry_run query bool false "Validate only, do not write anything"
+// @Param on_duplicate query string false "What to do with rows matching an existing subscription by user, service and start date" Enums(skip, update, fail) default(fail)
+// @Param file body string true "CSV data"
+// @Param Idempotency-Key header string false "Unique key to safely retry the request"
+// @Success 200 {object} ImportResponse
+// @Failure 400 {string} string "Invalid parameter format"
+// @Failure 413 {string} string "Request Entity Too Large"
+// @Failure 409 {object} ImportResponse "Duplicate or overlapping subscriptions"
+// @Failure 415 {string} string "Unsupported Media Type"
+// @Failure 422 {object} ImportResponse "Invalid rows"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 429 {string} string "Too Many Requests"
+// @Failure 503 {string} string "Service Unavailable"
+// @Failure 504 {string} string "Gateway Timeout"
+// @Router /v1/subscriptions/import [post]
+func (app *application) subscriptionImport(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/csv" {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	query := r.URL.Query()
+
+	var dryRun bool
+	if dryRunStr := query.Get("dry_run"); dryRunStr != "" {
+		dryRun, err = strconv.ParseBool(dryRunStr)
+		if err != nil {
+			http.Error(w, "Invalid dry_run format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	policy := models.DuplicateFail
+	if policyStr := query.Get("on_duplicate"); policyStr != "" {
+		policy = models.DuplicatePolicy(policyStr)
+		if policy != models.DuplicateSkip && policy != models.DuplicateUpdate && policy != models.DuplicateFail {
+			http.Error(w, "Invalid on_duplicate value", http.StatusBadRequest)
+			return
+		}
+	}
+
 	reader := r.Body
 	defer reader.Close()
 
-	body, err := io.ReadAll(reader)
+	subscriptions, lines, lineErrors, err := parseSubscriptionsCSV(reader, app.ownerID(r))
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			http.Error(w, fmt.Sprintf("body must not be larger than %d bytes", maxBytesError.Limit), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
 		return
 	}
 
-	var reqBody subscriptionUpdateBody
+	data := ImportResponse{
+		DryRun: dryRun,
+		Rows:   len(lines) + len(lineErrors),
+		Errors: lineErrors,
+	}
+
+	if len(lineErrors) > 0 {
+		status := http.StatusUnprocessableEntity
+		if dryRun {
+			status = http.StatusOK
+		}
+		app.writeJSON(w, r, status, data)
+		return
+	}
 
-	err = json.Unmarshal(body, &reqBody)
+	result, err := app.tenantSubscriptions(r).Import(r.Context(), subscriptions, policy, dryRun)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		if errors.Is(err, models.ErrDuplicateRecord) {
+			for _, idx := range result.Duplicates {
+				data.Errors = append(data.Errors, ImportLineError{
+					Line:  lines[idx],
+					Error: "duplicate of an existing subscription",
+				})
+			}
+
+			status := http.StatusConflict
+			if dryRun {
+				status = http.StatusOK
+			}
+			app.writeJSON(w, r, status, data)
+		} else if errors.Is(err, models.ErrOverlap) {
+			for _, idx := range result.Overlaps {
+				data.Errors = append(data.Errors, ImportLineError{
+					Line:  lines[idx],
+					Error: "overlaps with another subscription of the user to the service",
+				})
+			}
+
+			status := http.StatusConflict
+			if dryRun {
+				status = http.StatusOK
+			}
+			app.writeJSON(w, r, status, data)
+		} else {
+			app.serverError(w, r, err)
+		}
 		return
 	}
 
-	startDate, err := time.Parse("2006-01-02", reqBody.StartDate)
+	if len(result.Overlaps) > 0 {
+		msg := fmt.Sprintf("%d imported subscriptions overlap with others", len(result.Overlaps))
+		app.requestLogger(r).WarnContext(r.Context(), msg, "method", r.Method, "uri", r.URL.RequestURI())
+		w.Header().Add("Warning", fmt.Sprintf("299 - %q", msg))
+	}
+
+	data.Inserted = result.Inserted
+	data.Updated = result.Updated
+	data.Skipped = result.Skipped
+
+	app.writeJSON(w, r, http.StatusOK, data)
+}
+
+var subscriptionCSVHeader = []string{"id", "user_id", "service_name", "price", "start_date", "end_date"}
+
+func subscriptionCSVRecord(s models.Subscription) []string {
+	var endDate string
+	if s.EndDate != nil {
+		endDate = s.EndDate.Format("2006-01-02")
+	}
+
+	return []string{
+		s.ID.String(),
+		s.UserID.String(),
+		s.ServiceName,
+		strconv.Itoa(s.Price),
+		s.StartDate.Format("2006-01-02"),
+		endDate,
+	}
+}
+
+// parseSubscriptionsCSV reads subscriptions from CSV with a header row. It
+// returns the parsed subscriptions together with their line numbers and a
+// list of per-line validation errors. If ownerID is set, rows of other users
+// are rejected. A non-nil error means the file itself could not be read.
+func parseSubscriptionsCSV(r io.Reader, ownerID *uuid.UUID) ([]models.Subscription, []int, []ImportLineError, error) {
+	var (
+		subscriptions []models.Subscription
+		lines         []int
+		lineErrors    []ImportLineError
+	)
+
+	csvReader := csv.NewReader(r)
+	csvReader.TrimLeadingSpace = true
+
+	header, err := csvReader.Read()
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		if errors.Is(err, io.EOF) {
+			return nil, nil, nil, errors.New("CSV header is missing")
+		}
+		return nil, nil, nil, fmt.Errorf("Invalid CSV header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+
+	for _, name := range []string{"user_id", "service_name", "price", "start_date"} {
+		if _, ok := columns[name]; !ok {
+			return nil, nil, nil, fmt.Errorf("CSV header is missing column %s", name)
+		}
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	type key struct {
+		userID      uuid.UUID
+		serviceName string
+		startDate   time.Time
+	}
+	seen := make(map[key]int)
+
+	csvReader.FieldsPerRecord = len(header)
+
+	for {
+		record, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				lineErrors = append(lineErrors, ImportLineError{Line: parseErr.Line, Error: parseErr.Err.Error()})
+				continue
+			}
+			return nil, nil, nil, err
+		}
+
+		line, _ := csvReader.FieldPos(0)
+
+		price, err := strconv.Atoi(field(record, "price"))
+		if err != nil {
+			lineErrors = append(lineErrors, ImportLineError{Line: line, Error: "invalid price"})
+			continue
+		}
+
+		body := subscriptionCreateBody{
+			UserID:      field(record, "user_id"),
+			ServiceName: field(record, "service_name"),
+			Price:       price,
+			StartDate:   field(record, "start_date"),
+			EndDate:     field(record, "end_date"),
+		}
+
+		subscription, err := body.validate()
+		if err != nil {
+			lineErrors = append(lineErrors, ImportLineError{Line: line, Error: err.Error()})
+			continue
+		}
+
+		if ownerID != nil && subscription.UserID != *ownerID {
+			lineErrors = append(lineErrors, ImportLineError{Line: line, Error: "user_id does not match the caller"})
+			continue
+		}
+
+		k := key{subscription.UserID, subscription.ServiceName, subscription.StartDate}
+		if prev, ok := seen[k]; ok {
+			lineErrors = append(lineErrors, ImportLineError{Line: line, Error: fmt.Sprintf("duplicate of line %d", prev)})
+			continue
+		}
+		seen[k] = line
+
+		subscriptions = append(subscriptions, subscription)
+		lines = append(lines, line)
+	}
+
+	return subscriptions, lines, lineErrors, nil
+}
+
+// userSubscriptionOverlaps godoc
+// @Summary List overlapping subscriptions of a user
+// @Description Get pairs of the user's subscriptions to the same service with intersecting periods
+// @Tags subscriptions
+// @Accept json
+// @Produce json
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Param X-Tenant-ID header string false "Tenant ID, must match the credentials if given"
+// @Param user_id path string true "User ID" Format(uuid)
+// @Param If-None-Match header string false "ETag of a previously received response"
+// @Success 200 {object} OverlapListResponse
+// @Success 304 {string} string "Not Modified"
+// @Failure 400 {string} string "Invalid UUID format"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 406 {string} string "Not Acceptable"
+// @Failure 429 {string} string "Too Many Requests"
+// @Failure 503 {string} string "Service Unavailable"
+// @Failure 504 {string} string "Gateway Timeout"
+// @Router /v1/users/{user_id}/subscriptions/overlaps [get]
+func (app *application) userSubscriptionOverlaps(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(r.PathValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid UUID format", http.StatusBadRequest)
 		return
 	}
 
-	var endDate *time.Time
-	if reqBody.EndDate != "" {
-		t, err := time.Parse("2006-01-02", reqBody.EndDate)
+	if ownerID := app.ownerID(r); ownerID != nil && userID != *ownerID {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	overlaps, err := app.tenantSubscriptions(r).Overlaps(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := OverlapListResponse{
+		Overlaps: overlaps,
+	}
+
+	if app.notModified(w, r, data) {
+		return
+	}
+
+	app.writeResponse(w, r, http.StatusOK, data)
+}
+
+// apiKeyCreate godoc
+// @Summary Issue API key
+// @Description Issue a new API key. The key itself is returned only once.
+// @Tags api-keys
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param api_key body apiKeyCreateBody true "API key data"
+// @Success 200 {object} APIKeyCreateResponse
+// @Failure 400 {string} string "Bad Request"
+// @Failure 413 {string} string "Request Entity Too Large"
+// @Failure 415 {string} string "Unsupported Media Type"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Router /v1/api-keys [post]
+func (app *application) apiKeyCreate(w http.ResponseWriter, r *http.Request) {
+	var reqBody apiKeyCreateBody
+
+	if !app.readJSON(w, r, &reqBody) {
+		return
+	}
+
+	if reqBody.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	err := validateScopes(reqBody.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var expiresAt *time.Time
+	if reqBody.ExpiresAt != "" {
+		t, err := time.Parse(time.RFC3339, reqBody.ExpiresAt)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			http.Error(w, "Invalid expires_at format", http.StatusBadRequest)
 			return
 		}
-		endDate = &t
+		expiresAt = &t
 	}
 
-	_, err = app.subscriptions.Update(id, reqBody.UserID, reqBody.ServiceName, reqBody.Price, startDate, endDate)
+	apiKey, key, err := app.apiKeys.Insert(r.Context(), app.tenantID(r), reqBody.Name, reqBody.Scopes, expiresAt)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		app.serverError(w, r, err)
 		return
 	}
 
-	data := IDResponse{
-		ID: id,
+	data := APIKeyCreateResponse{
+		APIKey: apiKey,
+		Key:    key,
 	}
 
-	jsonBytes, err := json.Marshal(data)
+	app.writeJSON(w, r, http.StatusOK, data)
+}
+
+// apiKeyList godoc
+// @Summary List API keys
+// @Description Get all issued API keys, including expired and revoked ones
+// @Tags api-keys
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {object} APIKeyListResponse
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Router /v1/api-keys [get]
+func (app *application) apiKeyList(w http.ResponseWriter, r *http.Request) {
+	apiKeys, err := app.apiKeys.List(r.Context(), app.tenantID(r))
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonBytes)
+	data := APIKeyListResponse{
+		APIKeys: apiKeys,
+	}
+
+	app.writeJSON(w, r, http.StatusOK, data)
 }
 
-// subscriptionDelete godoc
-// @Summary Delete subscription
-// @Description Delete a subscription by ID
-// @Tags subscriptions
+// apiKeyRevoke godoc
+// @Summary Revoke API key
+// @Description Revoke an API key by ID
+// @Tags api-keys
 // @Accept json
 // @Produce json
-// @Param id path string true "Subscription ID" Format(uuid)
+// @Security ApiKeyAuth
+// @Param id path string true "API key ID" Format(uuid)
 // @Success 200 {string} string "OK"
 // @Failure 400 {string} string "Invalid UUID format"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
 // @Failure 404 {string} string "Not Found"
-// @Router /subscriptions/{id} [delete]
-func (app *application) subscriptionDelete(w http.ResponseWriter, r *http.Request) {
+// @Router /v1/api-keys/{id} [delete]
+func (app *application) apiKeyRevoke(w http.ResponseWriter, r *http.Request) {
 	id, err := uuid.Parse(r.PathValue("id"))
 	if err != nil {
 		http.Error(w, "Invalid UUID format", http.StatusBadRequest)
 		return
 	}
 
-	err = app.subscriptions.Delete(id)
+	err = app.apiKeys.Revoke(r.Context(), app.tenantID(r), id)
 
 	if err != nil {
 		if errors.Is(err, models.ErrNoRecord) {
@@ -402,3 +1077,74 @@ func (app *application) subscriptionDelete(w http.ResponseWriter, r *http.Reques
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// healthz godoc
+// @Summary Liveness probe
+// @Description Report that the process is alive
+// @Tags health
+// @Produce json
+// @Success 200 {object} HealthResponse
+// @Router /healthz [get]
+func (app *application) healthz(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, r, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// readyz godoc
+// @Summary Readiness probe
+// @Description Report whether the service can take traffic: the database answers, its schema is migrated to at least the expected version and the server is not shutting down
+// @Tags health
+// @Produce json
+// @Success 200 {object} ReadinessResponse
+// @Failure 503 {object} ReadinessResponse
+// @Router /readyz [get]
+func (app *application) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	data := ReadinessResponse{
+		Status: "ok",
+		Checks: map[string]string{
+			"database":   "ok",
+			"migrations": "ok",
+			"shutdown":   "ok",
+		},
+	}
+
+	fail := func(check, reason string) {
+		data.Status = "unavailable"
+		data.Checks[check] = reason
+	}
+
+	if app.shuttingDown.Load() {
+		fail("shutdown", "shutting down")
+	}
+
+	// The probe is unauthenticated, so driver errors, which name the
+	// database host, go to the log and the response gets a fixed reason.
+	err := app.health.Ping(ctx)
+	if err != nil {
+		app.requestLogger(r).WarnContext(r.Context(), err.Error(), "check", "database")
+		fail("database", "unreachable")
+		fail("migrations", "unknown")
+	} else {
+		version, err := app.health.SchemaVersion(ctx)
+		switch {
+		case err != nil:
+			app.requestLogger(r).WarnContext(r.Context(), err.Error(), "check", "migrations")
+			fail("migrations", "error")
+		case version < app.schemaVersion:
+			fail("migrations", fmt.Sprintf("at version %d, expected %d", version, app.schemaVersion))
+		case version > app.schemaVersion:
+			// Migrations run before a rolling deploy replaces the old
+			// instances, which must keep serving meanwhile.
+			data.Checks["migrations"] = fmt.Sprintf("ok, at version %d, ahead of %d", version, app.schemaVersion)
+		}
+	}
+
+	status := http.StatusOK
+	if data.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	app.writeJSON(w, r, status, data)
+}
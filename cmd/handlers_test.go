@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edzh1/rest-effective-mobile/internal/models"
+)
+
+func TestSubscriptionWriteValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantMsg string
+	}{
+		{
+			name:    "End before start",
+			body:    `{"user_id":"60601fee-2bf1-4721-ae6f-7636e79a0cba","service_name":"Yandex Plus","price":400,"start_date":"2025-07-01","end_date":"2025-06-01"}`,
+			wantMsg: "end_date is before start_date",
+		},
+		{
+			name:    "Negative price",
+			body:    `{"user_id":"60601fee-2bf1-4721-ae6f-7636e79a0cba","service_name":"Yandex Plus","price":-1,"start_date":"2025-07-01"}`,
+			wantMsg: "price must not be negative",
+		},
+		{
+			name:    "Empty service name",
+			body:    `{"user_id":"60601fee-2bf1-4721-ae6f-7636e79a0cba","service_name":"","price":400,"start_date":"2025-07-01"}`,
+			wantMsg: "service_name is required",
+		},
+		{
+			name:    "Invalid user id",
+			body:    `{"user_id":"nope","service_name":"Yandex Plus","price":400,"start_date":"2025-07-01"}`,
+			wantMsg: "invalid user_id",
+		},
+	}
+
+	app := newTestApplication(t)
+
+	for _, tt := range tests {
+		t.Run("Create/"+tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			app.subscriptionCreate(rr, newJSONRequest(t, http.MethodPost, "/v1/subscriptions", tt.body))
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d; want %d", rr.Code, http.StatusBadRequest)
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantMsg) {
+				t.Errorf("got body %q; want it to contain %q", rr.Body.String(), tt.wantMsg)
+			}
+		})
+
+		t.Run("Update/"+tt.name, func(t *testing.T) {
+			r := newJSONRequest(t, http.MethodPut, "/v1/subscriptions/a3509860-d66f-4be4-8984-0b7a15b8f10c", tt.body)
+			r.SetPathValue("id", "a3509860-d66f-4be4-8984-0b7a15b8f10c")
+
+			rr := httptest.NewRecorder()
+			app.subscriptionUpdate(rr, r)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d; want %d", rr.Code, http.StatusBadRequest)
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantMsg) {
+				t.Errorf("got body %q; want it to contain %q", rr.Body.String(), tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestReadyzHidesDatabaseErrors(t *testing.T) {
+	db, err := sql.Open("postgres", "host=127.0.0.1 port=1 user=probe dbname=probe sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	app := newTestApplication(t)
+	app.health = &models.HealthModel{DB: db}
+
+	rr := httptest.NewRecorder()
+	app.readyz(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	var data ReadinessResponse
+	err = json.NewDecoder(rr.Body).Decode(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Checks["database"] != "unreachable" {
+		t.Errorf("got database check %q; want %q", data.Checks["database"], "unreachable")
+	}
+}
+
+func TestOverlapsNegotiation(t *testing.T) {
+	app := newTestApplication(t)
+
+	start := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+	data := OverlapListResponse{Overlaps: []models.Overlap{{
+		Subscription:  models.Subscription{ServiceName: "Yandex Plus", Price: 400, StartDate: start},
+		ConflictsWith: models.Subscription{ServiceName: "Yandex Plus", Price: 300, StartDate: start},
+	}}}
+	handler := app.negotiate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.writeResponse(w, r, http.StatusOK, data)
+	}))
+
+	tests := []struct {
+		name            string
+		handler         http.Handler
+		accept          string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{name: "JSON", handler: handler, accept: "application/json", wantStatus: http.StatusOK, wantContentType: "application/json", wantBody: `"conflicts_with":`},
+		{name: "CSV", handler: handler, accept: "text/csv", wantStatus: http.StatusOK, wantContentType: "text/csv; charset=utf-8", wantBody: "end_date,conflicts_with_id,"},
+		{name: "NDJSON", handler: handler, accept: "application/x-ndjson", wantStatus: http.StatusOK, wantContentType: "application/x-ndjson", wantBody: `{"subscription":`},
+		{name: "Route", handler: app.routes(), accept: "application/xml", wantStatus: http.StatusNotAcceptable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/users/60601fee-2bf1-4721-ae6f-7636e79a0cba/subscriptions/overlaps", nil)
+			r.Header.Set("Accept", tt.accept)
+
+			rr := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d", rr.Code, tt.wantStatus)
+			}
+			if got := rr.Header().Get("Content-Type"); tt.wantContentType != "" && got != tt.wantContentType {
+				t.Errorf("got content type %q; want %q", got, tt.wantContentType)
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("got body %q; want it to contain %q", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
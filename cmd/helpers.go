@@ -1,10 +1,45 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edzh1/rest-effective-mobile/internal/auth"
+	"github.com/edzh1/rest-effective-mobile/internal/models"
+	"github.com/google/uuid"
 )
 
+// requestLogger returns the logger of the request, tagged with its id, or
+// the application logger outside of the requestID middleware.
+func (app *application) requestLogger(r *http.Request) *slog.Logger {
+	return app.loggerFrom(r.Context())
+}
+
+func (app *application) loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey).(*slog.Logger); ok {
+		return logger
+	}
+	return app.logger
+}
+
 func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
 	var (
 		method = r.Method
@@ -12,6 +47,573 @@ func (app *application) serverError(w http.ResponseWriter, r *http.Request, err
 		trace  = string(debug.Stack())
 	)
 
-	app.logger.Error(err.Error(), "method", method, "uri", uri, "trace", trace)
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client has gone away, there is nobody to respond to.
+		app.requestLogger(r).InfoContext(r.Context(), "request canceled", "method", method, "uri", uri)
+		return
+	case errors.Is(err, models.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		app.requestLogger(r).ErrorContext(r.Context(), err.Error(), "method", method, "uri", uri)
+		http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		return
+	case errors.Is(err, models.ErrUnavailable):
+		app.requestLogger(r).ErrorContext(r.Context(), err.Error(), "method", method, "uri", uri)
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	app.requestLogger(r).ErrorContext(r.Context(), err.Error(), "method", method, "uri", uri, "trace", trace)
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
+
+// isDatabaseFailure reports whether err means the database could not serve
+// the query rather than that the input was rejected.
+func isDatabaseFailure(err error) bool {
+	return errors.Is(err, models.ErrTimeout) || errors.Is(err, models.ErrUnavailable) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+const (
+	formatJSON   = "application/json"
+	formatCSV    = "text/csv"
+	formatNDJSON = "application/x-ndjson"
+)
+
+// responseFormats lists the media types writeResponse can produce, in order
+// of preference.
+var responseFormats = []string{formatJSON, formatCSV, formatNDJSON}
+
+// tabularResponse is implemented by responses that can also be rendered as
+// CSV or NDJSON rows.
+type tabularResponse interface {
+	csvHeader() []string
+	csvRecords() [][]string
+	ndjsonValues() []any
+}
+
+// writeResponse encodes data in the format chosen by the negotiate middleware,
+// falling back to JSON for routes without negotiation or for data that has no
+// tabular form.
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data any) {
+	format, _ := r.Context().Value(responseFormatContextKey).(string)
+	tabular, ok := data.(tabularResponse)
+	if !ok || format == "" || format == formatJSON {
+		app.writeJSON(w, r, status, data)
+		return
+	}
+
+	var buf bytes.Buffer
+
+	switch format {
+	case formatCSV:
+		csvWriter := csv.NewWriter(&buf)
+		csvWriter.Write(tabular.csvHeader())
+		csvWriter.WriteAll(tabular.csvRecords())
+		if err := csvWriter.Error(); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	case formatNDJSON:
+		encoder := json.NewEncoder(&buf)
+		for _, v := range tabular.ndjsonValues() {
+			if err := encoder.Encode(v); err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", formatNDJSON)
+	}
+
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// notModified sets ETag and Cache-Control for a report and reports whether
+// the client already has it, in which case 304 has been sent. The ETag is
+// weak, as the same data may be sent with different encodings.
+func (app *application) notModified(w http.ResponseWriter, r *http.Request, data any) bool {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return false
+	}
+
+	format, _ := r.Context().Value(responseFormatContextKey).(string)
+	hash := sha256.New()
+	hash.Write([]byte(format + "\n"))
+	hash.Write(body)
+	etag := `W/"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(app.reportMaxAge.Seconds())))
+
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches compares an If-None-Match header with etag using the weak
+// comparison.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateMediaType picks the offer that best matches an Accept header,
+// preferring earlier offers on equal quality. An empty header accepts the
+// first offer; an empty result means nothing is acceptable.
+func negotiateMediaType(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+
+	for _, offer := range offers {
+		offerType, _, _ := strings.Cut(offer, "/")
+		q, specificity := 0.0, -1
+
+		for _, part := range strings.Split(accept, ",") {
+			params := strings.Split(part, ";")
+			mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+			rangeType, rangeSubtype, _ := strings.Cut(mediaRange, "/")
+
+			var s int
+			switch {
+			case mediaRange == offer:
+				s = 2
+			case rangeType == offerType && rangeSubtype == "*":
+				s = 1
+			case mediaRange == "*/*" || mediaRange == "*":
+				s = 0
+			default:
+				continue
+			}
+
+			if s < specificity {
+				continue
+			}
+
+			rangeQ := 1.0
+			for _, param := range params[1:] {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.ToLower(key) == "q" {
+					if v, err := strconv.ParseFloat(value, 64); err == nil {
+						rangeQ = v
+					}
+				}
+			}
+
+			q, specificity = rangeQ, s
+		}
+
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best
+}
+
+func (app *application) writeJSON(w http.ResponseWriter, r *http.Request, status int, data any) {
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+func readSubscriptionFilter(query url.Values) (models.SubscriptionFilter, error) {
+	var filter models.SubscriptionFilter
+
+	if userIDStr := query.Get("user_id"); userIDStr != "" {
+		userID, err := uuid.Parse(userIDStr)
+		if err != nil {
+			return filter, errors.New("Invalid user_id format")
+		}
+		filter.UserID = &userID
+	}
+
+	if serviceName := query.Get("service_name"); serviceName != "" {
+		filter.ServiceName = &serviceName
+	}
+
+	if startDateStr := query.Get("start_date"); startDateStr != "" {
+		startDate, err := time.Parse("2006-01-02", startDateStr)
+		if err != nil {
+			return filter, errors.New("Invalid start_date format")
+		}
+		filter.StartDate = &startDate
+	}
+
+	if endDateStr := query.Get("end_date"); endDateStr != "" {
+		endDate, err := time.Parse("2006-01-02", endDateStr)
+		if err != nil {
+			return filter, errors.New("Invalid end_date format")
+		}
+		filter.EndDate = &endDate
+	}
+
+	return filter, nil
+}
+
+// filterQuery turns filter fields given outside of a query string into query
+// parameters for readSubscriptionFilter.
+func filterQuery(userID, serviceName, startDate, endDate string) url.Values {
+	query := url.Values{}
+	for key, value := range map[string]string{
+		"user_id":      userID,
+		"service_name": serviceName,
+		"start_date":   startDate,
+		"end_date":     endDate,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	return query
+}
+
+const (
+	overlapReject = "reject"
+	overlapWarn   = "warn"
+)
+
+// inputError is a rejected field of a subscription.
+type inputError struct {
+	message string
+}
+
+func (e inputError) Error() string {
+	return e.message
+}
+
+// prepareSubscription validates a subscription sent to be created or updated
+// through any of the APIs: its fields and its owner. Overlaps are checked by
+// the write itself, which holds the lock serializing it with the others.
+func (app *application) prepareSubscription(ctx context.Context, body subscriptionCreateBody) (models.Subscription, error) {
+	subscription, err := body.validate()
+	if err != nil {
+		return subscription, inputError{err.Error()}
+	}
+
+	if ownerID := ownerIDFrom(ctx); ownerID != nil && subscription.UserID != *ownerID {
+		return subscription, errForbidden
+	}
+
+	return subscription, nil
+}
+
+// checkSubscription validates a subscription sent to be created or updated
+// with prepareSubscription, the same way as the other transports do. It
+// returns false if a response has already been written and the handler must
+// stop.
+func (app *application) checkSubscription(w http.ResponseWriter, r *http.Request, body subscriptionCreateBody) (models.Subscription, bool) {
+	subscription, err := app.prepareSubscription(r.Context(), body)
+
+	var inputErr inputError
+	switch {
+	case errors.As(err, &inputErr):
+		http.Error(w, inputErr.message, http.StatusBadRequest)
+		return subscription, false
+	case errors.Is(err, errForbidden):
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return subscription, false
+	}
+
+	return subscription, true
+}
+
+// overlapWarning logs and describes the subscriptions a written one overlaps,
+// which only the warn policy lets through, or returns an empty string if
+// there are none.
+func (app *application) overlapWarning(ctx context.Context, subscription models.Subscription, overlapping []models.Subscription) string {
+	if len(overlapping) == 0 {
+		return ""
+	}
+
+	msg := overlapMessage(overlapping)
+	app.loggerFrom(ctx).WarnContext(ctx, msg, "user_id", subscription.UserID, "service_name", subscription.ServiceName)
+	return msg
+}
+
+// warnOverlaps reports the overlaps of a written subscription in the Warning
+// header.
+func (app *application) warnOverlaps(w http.ResponseWriter, r *http.Request, subscription models.Subscription, overlapping []models.Subscription) {
+	if warning := app.overlapWarning(r.Context(), subscription, overlapping); warning != "" {
+		w.Header().Add("Warning", fmt.Sprintf("299 - %q", warning))
+	}
+}
+
+func overlapMessage(overlapping []models.Subscription) string {
+	ids := make([]string, 0, len(overlapping))
+	for _, s := range overlapping {
+		ids = append(ids, s.ID.String())
+	}
+
+	return fmt.Sprintf("Subscription overlaps with %s", strings.Join(ids, ", "))
+}
+
+// writeFailure responds to a failed Insert or Update. Overlaps found while
+// the write held its lock are conflicts; other failures than those of the
+// database are treated as invalid input.
+func (app *application) writeFailure(w http.ResponseWriter, r *http.Request, err error) {
+	var overlapErr *models.OverlapError
+
+	switch {
+	case errors.As(err, &overlapErr):
+		http.Error(w, overlapMessage(overlapErr.Subscriptions), http.StatusConflict)
+	case isDatabaseFailure(err):
+		app.serverError(w, r, err)
+	default:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	}
+}
+
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+
+	for _, scope := range scopes {
+		if !slices.Contains(models.Scopes, scope) {
+			return fmt.Errorf("unknown scope %s", scope)
+		}
+	}
+
+	return nil
+}
+
+// ownerID returns the user a request is limited to, or nil if the caller may
+// access subscriptions of every user.
+func (app *application) ownerID(r *http.Request) *uuid.UUID {
+	return ownerIDFrom(r.Context())
+}
+
+func ownerIDFrom(ctx context.Context) *uuid.UUID {
+	identity, ok := ctx.Value(identityContextKey).(auth.Identity)
+	if !ok || identity.Admin {
+		return nil
+	}
+
+	userID, err := uuid.Parse(identity.Subject)
+	if err != nil {
+		return &uuid.Nil
+	}
+
+	return &userID
+}
+
+// restrictFilter limits filter to ownerID. It returns false if the filter
+// asks for another user's subscriptions.
+func restrictFilter(filter *models.SubscriptionFilter, ownerID *uuid.UUID) bool {
+	if ownerID == nil {
+		return true
+	}
+
+	if filter.UserID != nil && *filter.UserID != *ownerID {
+		return false
+	}
+
+	filter.UserID = ownerID
+	return true
+}
+
+func (app *application) tenantID(r *http.Request) string {
+	return tenantIDFrom(r.Context())
+}
+
+func tenantIDFrom(ctx context.Context) string {
+	tenantID, _ := ctx.Value(tenantContextKey).(string)
+	return tenantID
+}
+
+// tenantSubscriptions returns the subscription model scoped to the tenant of
+// the request.
+func (app *application) tenantSubscriptions(r *http.Request) *models.SubscriptionModel {
+	return app.subscriptionsFor(r.Context())
+}
+
+func (app *application) subscriptionsFor(ctx context.Context) *models.SubscriptionModel {
+	return app.subscriptions.ForTenant(tenantIDFrom(ctx))
+}
+
+// clientID identifies the caller of a request within its tenant: by API key,
+// JWT subject or, for anonymous requests, by IP address.
+func (app *application) clientID(r *http.Request) string {
+	return callerID(r.Context(), app.clientIP(r))
+}
+
+func callerID(ctx context.Context, ip string) string {
+	tenantID := tenantIDFrom(ctx)
+
+	if p := principal(ctx); p != "" {
+		return tenantID + "/" + p
+	}
+
+	return tenantID + "/ip:" + ip
+}
+
+// principal names the authenticated caller by API key or JWT subject. It is
+// empty for anonymous requests.
+func principal(ctx context.Context) string {
+	if apiKey, ok := ctx.Value(apiKeyContextKey).(models.APIKey); ok {
+		return "key:" + apiKey.ID.String()
+	}
+	if identity, ok := ctx.Value(identityContextKey).(auth.Identity); ok {
+		return "sub:" + identity.Subject
+	}
+
+	return ""
+}
+
+// clientIP returns the address of the client. When the request comes from a
+// trusted proxy, X-Forwarded-For is followed from the right up to the first
+// address that is not a trusted proxy.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !app.trustedProxy(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		host = addr
+		if !app.trustedProxy(addr) {
+			break
+		}
+	}
+
+	return host
+}
+
+func (app *application) trustedProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range app.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// extendWriteDeadline replaces the server-wide write timeout of a response
+// with timeout, or removes it if timeout is zero.
+func (app *application) extendWriteDeadline(w http.ResponseWriter, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	err := http.NewResponseController(w).SetWriteDeadline(deadline)
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+// readJSON decodes a request body holding a single JSON object into dst,
+// rejecting unknown fields. It returns false if the body was rejected and a
+// response has already been written.
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err = dec.Decode(dst)
+	if err == nil {
+		err = dec.Decode(&struct{}{})
+		if !errors.Is(err, io.EOF) {
+			err = errors.New("body must contain a single JSON value")
+		} else {
+			err = nil
+		}
+	}
+	if err == nil {
+		return true
+	}
+
+	var (
+		maxBytesError *http.MaxBytesError
+		syntaxError   *json.SyntaxError
+		typeError     *json.UnmarshalTypeError
+	)
+
+	switch {
+	case errors.As(err, &maxBytesError):
+		http.Error(w, fmt.Sprintf("body must not be larger than %d bytes", maxBytesError.Limit), http.StatusRequestEntityTooLarge)
+	case errors.As(err, &syntaxError):
+		http.Error(w, fmt.Sprintf("body contains malformed JSON at offset %d", syntaxError.Offset), http.StatusBadRequest)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		http.Error(w, "body contains malformed JSON", http.StatusBadRequest)
+	case errors.As(err, &typeError):
+		if typeError.Field != "" {
+			http.Error(w, fmt.Sprintf("body contains incorrect JSON type for field %q", typeError.Field), http.StatusBadRequest)
+		} else {
+			http.Error(w, fmt.Sprintf("body contains incorrect JSON type at offset %d", typeError.Offset), http.StatusBadRequest)
+		}
+	case errors.Is(err, io.EOF):
+		http.Error(w, "body must not be empty", http.StatusBadRequest)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		http.Error(w, "body contains unknown field "+strings.TrimPrefix(err.Error(), "json: unknown field "), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+
+	return false
+}
+
+// deleteExpiredIdempotencyKeys deletes expired idempotency keys every
+// interval until ctx is done.
+func (app *application) deleteExpiredIdempotencyKeys(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := app.idempotencyKeys.DeleteExpired(ctx)
+		if err != nil && ctx.Err() == nil {
+			app.logger.Error("deleting expired idempotency keys failed", "error", err.Error())
+			continue
+		}
+		if n > 0 {
+			app.logger.Debug("deleted expired idempotency keys", "count", n)
+		}
+	}
+}
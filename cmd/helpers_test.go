@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edzh1/rest-effective-mobile/internal/auth"
+	"github.com/edzh1/rest-effective-mobile/internal/models"
+	"github.com/google/uuid"
+)
+
+func TestWriteFailure(t *testing.T) {
+	overlapping := models.Subscription{ID: uuid.MustParse("a3509860-d66f-4be4-8984-0b7a15b8f10c")}
+
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "Overlap",
+			err:      fmt.Errorf("insert: %w", &models.OverlapError{Subscriptions: []models.Subscription{overlapping}}),
+			wantCode: http.StatusConflict,
+			wantBody: "Subscription overlaps with a3509860-d66f-4be4-8984-0b7a15b8f10c",
+		},
+		{
+			name:     "Timeout",
+			err:      models.ErrTimeout,
+			wantCode: http.StatusGatewayTimeout,
+		},
+		{
+			name:     "Rejected input",
+			err:      errors.New("pq: value too long"),
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	app := newTestApplication(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			app.writeFailure(rr, httptest.NewRequest(http.MethodPost, "/v1/subscriptions", nil), tt.err)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("got status %d; want %d", rr.Code, tt.wantCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("got body %q; want it to contain %q", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+// Exports outlive the server-wide write timeout.
+func TestExtendWriteDeadline(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		extend   bool
+		wantFull bool
+	}{
+		{name: "Server timeout", extend: false, wantFull: false},
+		{name: "No limit", extend: true, timeout: 0, wantFull: true},
+		{name: "Longer limit", extend: true, timeout: time.Minute, wantFull: true},
+	}
+
+	app := newTestApplication(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.extend {
+					err := app.extendWriteDeadline(w, tt.timeout)
+					if err != nil {
+						t.Error(err)
+					}
+				}
+
+				rc := http.NewResponseController(w)
+				for range 5 {
+					io.WriteString(w, "row\n")
+					rc.Flush()
+					time.Sleep(40 * time.Millisecond)
+				}
+			}))
+			srv.Config.WriteTimeout = 100 * time.Millisecond
+			srv.Start()
+			defer srv.Close()
+
+			res, err := srv.Client().Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			body, err := io.ReadAll(res.Body)
+			full := err == nil && string(body) == strings.Repeat("row\n", 5)
+			if full != tt.wantFull {
+				t.Errorf("got full body %t (%q, %v); want %t", full, body, err, tt.wantFull)
+			}
+		})
+	}
+}
+
+func TestPrincipal(t *testing.T) {
+	keyID := uuid.MustParse("6a2f41a3-c54c-fce8-32d2-0324e1c32e22")
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{name: "API key", ctx: context.WithValue(context.Background(), apiKeyContextKey, models.APIKey{ID: keyID}), want: "key:" + keyID.String()},
+		{name: "JWT", ctx: context.WithValue(context.Background(), identityContextKey, auth.Identity{Subject: "alice"}), want: "sub:alice"},
+		{name: "Anonymous", ctx: context.Background(), want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := principal(tt.ctx); got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,22 +1,62 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
 	"log"
 	"log/slog"
-	"net/http"
+	"net/netip"
 	"os"
-	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/edzh1/rest-effective-mobile/internal"
+	"github.com/edzh1/rest-effective-mobile/internal/auth"
+	"github.com/edzh1/rest-effective-mobile/internal/config"
+	"github.com/edzh1/rest-effective-mobile/internal/metrics"
 	"github.com/edzh1/rest-effective-mobile/internal/models"
+	"github.com/edzh1/rest-effective-mobile/internal/ratelimit"
+	"github.com/edzh1/rest-effective-mobile/internal/tracing"
+	"github.com/edzh1/rest-effective-mobile/migrations"
+	"github.com/graphql-go/graphql"
 	"github.com/joho/godotenv"
 
 	_ "github.com/edzh1/rest-effective-mobile/docs"
 )
 
 type application struct {
-	logger        *slog.Logger
-	subscriptions *models.SubscriptionModel
+	logger          *slog.Logger
+	subscriptions   *models.SubscriptionModel
+	idempotencyKeys *models.IdempotencyModel
+	idempotencyTTL  time.Duration
+	maxPage         int
+	swagger         bool
+	apiKeys         *models.APIKeyModel
+	authEnabled     bool
+	jwt             *auth.Verifier
+	defaultTenant   string
+	metrics         *metrics.Metrics
+	health          *models.HealthModel
+	schemaVersion   int64
+	shuttingDown    atomic.Bool
+	sticky          *stickyPrimary
+	trustedProxies  []netip.Prefix
+	rateLimiter     ratelimit.Store
+	rateLimits      map[string]ratelimit.Limit
+	maxBodyBytes    int64
+	maxImportBytes  int64
+	exportTimeout   time.Duration
+	corsConfig      config.CORS
+	headers         config.Headers
+	compression     config.Compression
+	reportMaxAge    time.Duration
+	deprecatedAt    time.Time
+	sunset          time.Time
+	graphqlSchema   graphql.Schema
+	graphqlLimits   queryLimits
 }
 
 // @title rest-effective-mobile/
@@ -24,40 +64,231 @@ type application struct {
 // @description Тестовое задание по управлению подписками.
 // @host localhost:3000
 // @BasePath /
+// @securityDefinitions.apikey ApiKeyAuth
+// @in header
+// @name X-API-Key
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+// @description JWT as "Bearer <token>"
 func main() {
+	issueAPIKey := flag.String("issue-api-key", "", "Issue an API key with the given name, print it and exit")
+	apiKeyScopes := flag.String("scopes", models.ScopeAdmin, "Comma-separated scopes of the issued API key")
+	apiKeyTTL := flag.Duration("expires-in", 0, "Lifetime of the issued API key, 0 for no expiry")
+	apiKeyTenant := flag.String("tenant", "", "Tenant of the issued API key, DEFAULT_TENANT if empty")
+
 	_ = godotenv.Load()
 
-	port, err := strconv.Atoi(os.Getenv("POSTGRES_PORT"))
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
 	if err != nil {
-		log.Fatalf("Wrong port %s", err)
+		log.Fatalf("Wrong configuration:\n%s", err)
 	}
 
-	dbCfg := internal.DSN{
-		Host:     os.Getenv("POSTGRES_HOST"),
-		Port:     port,
-		User:     os.Getenv("POSTGRES_USER"),
-		Password: os.Getenv("POSTGRES_PASSWORD"),
-		DBname:   os.Getenv("POSTGRES_DB"),
+	var jwtVerifier *auth.Verifier
+	if cfg.JWTEnabled() {
+		jwtVerifier, err = auth.NewVerifier(auth.JWTConfig(cfg.Auth.JWT))
+		if err != nil {
+			log.Fatalf("Wrong JWT configuration %s", err)
+		}
 	}
 
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	logger := newLogger(cfg.Log)
+
+	shutdownTracing, err := tracing.Init(context.Background(), tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.Endpoint,
+		ServiceName: "rest-effective-mobile",
+		SampleRatio: cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	defer shutdownTracing(context.Background())
 
-	db, err := internal.InitDB(dbCfg)
+	db, err := internal.InitDB(internal.DSN{
+		URL:             cfg.DB.URL,
+		Host:            cfg.DB.Host,
+		Port:            cfg.DB.Port,
+		User:            cfg.DB.User,
+		Password:        cfg.DB.Password,
+		DBname:          cfg.DB.Name,
+		SSLMode:         cfg.DB.SSLMode,
+		SSLRootCert:     cfg.DB.SSLRootCert,
+		SSLCert:         cfg.DB.SSLCert,
+		SSLKey:          cfg.DB.SSLKey,
+		MaxOpenConns:    cfg.DB.MaxOpenConns,
+		MaxIdleConns:    cfg.DB.MaxIdleConns,
+		ConnMaxLifetime: cfg.DB.ConnMaxLifetime,
+		ConnMaxIdleTime: cfg.DB.ConnMaxIdleTime,
+		ConnectTimeout:  cfg.DB.ConnectTimeout,
+	}, logger)
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
 	defer db.Close()
 
-	app := application{
-		logger:        logger,
-		subscriptions: &models.SubscriptionModel{DB: db},
+	if *issueAPIKey != "" {
+		scopes := strings.Split(*apiKeyScopes, ",")
+		err = validateScopes(scopes)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+
+		var expiresAt *time.Time
+		if *apiKeyTTL > 0 {
+			t := time.Now().Add(*apiKeyTTL)
+			expiresAt = &t
+		}
+
+		tenantID := *apiKeyTenant
+		if tenantID == "" {
+			tenantID = cfg.Tenancy.Default
+		}
+
+		_, key, err := (&models.APIKeyModel{DB: db, RowLevelSecurity: cfg.Tenancy.RLS}).Insert(context.Background(), tenantID, *issueAPIKey, scopes, expiresAt)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+
+		fmt.Println(key)
+		return
+	}
+
+	subscriptions := &models.SubscriptionModel{
+		DB:               db,
+		RowLevelSecurity: cfg.Tenancy.RLS,
+		PageSize:         cfg.Subscriptions.PageSize,
+		Timeouts:         models.QueryTimeouts(cfg.QueryTimeouts),
+		RejectOverlaps:   cfg.Subscriptions.OverlapPolicy == overlapReject,
+	}
+
+	if cfg.ReportCache.TTL > 0 {
+		subscriptions.Cache = models.NewReportCache(cfg.ReportCache.TTL)
+	}
+
+	if len(cfg.DB.Replicas) > 0 {
+		var replicaDBs []*sql.DB
+		for _, url := range cfg.DB.Replicas {
+			replicaDB, err := internal.OpenDB(internal.DSN{
+				URL:             url,
+				MaxOpenConns:    cfg.DB.MaxOpenConns,
+				MaxIdleConns:    cfg.DB.MaxIdleConns,
+				ConnMaxLifetime: cfg.DB.ConnMaxLifetime,
+				ConnMaxIdleTime: cfg.DB.ConnMaxIdleTime,
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				return
+			}
+			replicaDBs = append(replicaDBs, replicaDB)
+		}
+
+		replicas := models.NewReplicas(replicaDBs, logger)
+		defer replicas.Close()
+
+		ctx, stopMonitor := context.WithCancel(context.Background())
+		defer stopMonitor()
+		go replicas.Monitor(ctx, cfg.DB.ReplicaCheckInterval)
+
+		subscriptions.Replicas = replicas
 	}
 
-	logger.Info("starting server on " + os.Getenv("ADDR"))
-	err = http.ListenAndServe(os.Getenv("ADDR"), app.routes())
+	appMetrics := metrics.New(db, func() (map[string]int, error) {
+		return subscriptions.ActiveByTenant(context.Background())
+	}, cfg.Metrics.ActiveInterval)
+	subscriptions.ObserveQuery = appMetrics.ObserveQuery
+
+	schemaVersion, err := migrations.LatestVersion()
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
+
+	var trustedProxies []netip.Prefix
+	for _, proxy := range cfg.RateLimit.TrustedProxies {
+		prefix, _ := config.ParseCIDR(proxy)
+		trustedProxies = append(trustedProxies, prefix)
+	}
+
+	var rateLimits map[string]ratelimit.Limit
+	if cfg.RateLimit.Enabled {
+		rateLimits = map[string]ratelimit.Limit{
+			rateLimitRead:   rateLimitFromBudget(cfg.RateLimit.Read),
+			rateLimitWrite:  rateLimitFromBudget(cfg.RateLimit.Write),
+			rateLimitReport: rateLimitFromBudget(cfg.RateLimit.Report),
+		}
+	}
+
+	deprecatedAt, _ := config.ParseDate(cfg.Unversioned.DeprecatedAt)
+	sunset, _ := config.ParseDate(cfg.Unversioned.Sunset)
+
+	app := &application{
+		logger:          logger,
+		subscriptions:   subscriptions,
+		idempotencyKeys: &models.IdempotencyModel{DB: db, RowLevelSecurity: cfg.Tenancy.RLS},
+		idempotencyTTL:  cfg.Idempotency.TTL,
+		maxPage:         cfg.Subscriptions.MaxPage,
+		swagger:         cfg.Env == "dev" || cfg.Features.Swagger,
+		apiKeys:         &models.APIKeyModel{DB: db, RowLevelSecurity: cfg.Tenancy.RLS},
+		authEnabled:     cfg.Auth.Enabled,
+		jwt:             jwtVerifier,
+		defaultTenant:   cfg.Tenancy.Default,
+		metrics:         appMetrics,
+		health:          &models.HealthModel{DB: db},
+		schemaVersion:   schemaVersion,
+		sticky:          newStickyPrimary(cfg.DB.ReplicaStickyWindow),
+		trustedProxies:  trustedProxies,
+		rateLimiter:     ratelimit.NewMemoryStore(),
+		rateLimits:      rateLimits,
+		maxBodyBytes:    int64(cfg.Server.MaxBodyBytes),
+		maxImportBytes:  int64(cfg.Server.MaxImportBytes),
+		exportTimeout:   cfg.Server.ExportWriteTimeout,
+		corsConfig:      cfg.CORS,
+		headers:         cfg.Headers,
+		compression:     cfg.Compression,
+		reportMaxAge:    cfg.ReportCache.MaxAge,
+		deprecatedAt:    deprecatedAt,
+		sunset:          sunset,
+		graphqlLimits:   queryLimits{maxDepth: cfg.GraphQL.MaxDepth, maxComplexity: cfg.GraphQL.MaxComplexity},
+	}
+
+	app.graphqlSchema, err = app.newGraphQLSchema()
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	ctx, stopCleanup := context.WithCancel(context.Background())
+	defer stopCleanup()
+	go app.deleteExpiredIdempotencyKeys(ctx, cfg.Idempotency.CleanupInterval)
+
+	err = app.serve(cfg.Addr, cfg.Server, cfg.GRPC, cfg.Metrics)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+}
+
+func newLogger(cfg config.Log) *slog.Logger {
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(cfg.Level))
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if cfg.Format == "text" {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+
+	return slog.New(tracing.NewLogHandler(handler))
+}
+
+func rateLimitFromBudget(b config.RateLimitBudget) ratelimit.Limit {
+	return ratelimit.Limit{Rate: float64(b.RequestsPerMinute) / 60, Burst: b.Burst}
 }
@@ -1,16 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edzh1/rest-effective-mobile/internal/auth"
+	"github.com/edzh1/rest-effective-mobile/internal/models"
+	"github.com/google/uuid"
+	"github.com/justinas/alice"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
-func commonHeaders(next http.Handler) http.Handler {
+func (app *application) commonHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'self' fonts.googleapis.com; font-src fonts.gstatic.com")
+		if app.headers.ContentSecurityPolicy != "" {
+			w.Header().Set("Content-Security-Policy", app.headers.ContentSecurityPolicy)
+		}
+		if app.headers.FrameOptions != "" {
+			w.Header().Set("X-Frame-Options", app.headers.FrameOptions)
+		}
 		w.Header().Set("Referrer-Policy", "origin-when-cross-origin")
 		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "deny")
 		w.Header().Set("X-XSS-Protection", "0")
 
 		w.Header().Set("Server", "Go")
@@ -19,18 +39,77 @@ func commonHeaders(next http.Handler) http.Handler {
 	})
 }
 
+// deprecated marks responses of the unversioned aliases with Deprecation and
+// Sunset headers and links the same resource under /v1.
+func (app *application) deprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.deprecatedAt.IsZero() {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", app.deprecatedAt.Unix()))
+		}
+		if !app.sunset.IsZero() {
+			w.Header().Set("Sunset", app.sunset.UTC().Format(http.TimeFormat))
+		}
+		w.Header().Add("Link", fmt.Sprintf(`</v1%s>; rel="successor-version"`, r.URL.EscapedPath()))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// traceRequest starts a server span named after the route pattern, continuing
+// the trace from an incoming traceparent header.
+func (app *application) traceRequest(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.request",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + r.Pattern
+		}),
+	)
+}
+
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID takes the X-Request-ID header or generates a new id, echoes it
+// in the response and stores a logger carrying it in the request context.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		logger := app.logger.With("request_id", id)
+		ctx := context.WithValue(r.Context(), loggerContextKey, logger)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (app *application) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var (
-			ip     = r.RemoteAddr
+			ip     = app.clientIP(r)
 			proto  = r.Proto
 			method = r.Method
 			uri    = r.URL.RequestURI()
+			start  = time.Now()
+			logger = app.requestLogger(r)
 		)
 
-		app.logger.Info("received request", "ip", ip, "proto", proto, "method", method, "uri", uri)
+		logger.InfoContext(r.Context(), "received request", "ip", ip, "proto", proto, "method", method, "uri", uri)
 
-		next.ServeHTTP(w, r)
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			// Only aborted responses get past recoverPanic. They are logged
+			// on their way to net/http, which closes the connection.
+			err := recover()
+			logger.InfoContext(r.Context(), "completed request", "method", method, "uri", uri, "status", rw.status, "bytes", rw.bytes, "duration", time.Since(start), "aborted", err != nil)
+			if err != nil {
+				panic(err)
+			}
+		}()
+
+		next.ServeHTTP(rw, r)
 	})
 }
 
@@ -38,6 +117,12 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				// Handlers abort responses they cannot finish, so that the
+				// client sees them cut short; net/http closes the connection.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
 				w.Header().Set("Connection", "close")
 				app.serverError(w, r, fmt.Errorf("%s", err))
 			}
@@ -46,3 +131,532 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+func (app *application) negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+
+		format := negotiateMediaType(r.Header.Get("Accept"), responseFormats)
+		if format == "" {
+			http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), responseFormatContextKey, format)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// idempotent makes a request carrying an Idempotency-Key header run at most
+// once: repeats with the same body get the stored response replayed, and
+// repeats with a different body are rejected.
+func (app *application) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > 255 {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				http.Error(w, fmt.Sprintf("body must not be larger than %d bytes", maxBytesError.Limit), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			}
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.RequestURI())
+		hash.Write(body)
+		requestHash := hash.Sum(nil)
+
+		// Keys are scoped to the caller, so that callers of a tenant who
+		// happen to pick the same key don't get each other's responses.
+		caller := principal(r.Context())
+
+		record, claimed, err := app.idempotencyKeys.Claim(r.Context(), app.tenantID(r), caller, key, requestHash, app.idempotencyTTL)
+		if err != nil {
+			if errors.Is(err, models.ErrNoRecord) {
+				http.Error(w, "Request with this Idempotency-Key is in progress", http.StatusConflict)
+			} else {
+				app.serverError(w, r, err)
+			}
+			return
+		}
+
+		if !claimed {
+			switch {
+			case !bytes.Equal(record.RequestHash, requestHash):
+				http.Error(w, "Idempotency-Key was used with a different request", http.StatusUnprocessableEntity)
+			case record.Status == nil:
+				http.Error(w, "Request with this Idempotency-Key is in progress", http.StatusConflict)
+			default:
+				if record.ContentType != nil {
+					w.Header().Set("Content-Type", *record.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(*record.Status)
+				w.Write(record.Body)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		defer func() {
+			// The outcome is stored even if the client has gone away, so that
+			// its retry gets the response.
+			ctx := context.WithoutCancel(r.Context())
+
+			// Server errors and panics are not stored, so the client can retry.
+			p := recover()
+			if p != nil || rec.status >= http.StatusInternalServerError {
+				err = app.idempotencyKeys.Release(ctx, app.tenantID(r), caller, key)
+			} else {
+				err = app.idempotencyKeys.Complete(ctx, app.tenantID(r), caller, key, rec.status, w.Header().Get("Content-Type"), rec.body.Bytes())
+			}
+
+			if err != nil {
+				app.requestLogger(r).ErrorContext(r.Context(), err.Error(), "method", r.Method, "uri", r.URL.RequestURI())
+			}
+
+			if p != nil {
+				panic(p)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// responseRecorder passes the response through while keeping a copy of the
+// status code and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// authenticate identifies the caller either by an API key from the X-API-Key
+// header or by a JWT from the Authorization header and stores the result in
+// the request context. Requests without credentials pass through anonymously
+// and are rejected later by requireScope.
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := app.identify(r.Context(), r.Header.Get("X-API-Key"), r.Header.Get("Authorization"))
+		switch {
+		case errors.Is(err, errInvalidAPIKey):
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		case errors.Is(err, errInvalidToken):
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		case err != nil:
+			app.serverError(w, r, err)
+		default:
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+	})
+}
+
+var (
+	errInvalidAPIKey = errors.New("invalid API key")
+	errInvalidToken  = errors.New("invalid token")
+)
+
+// identify checks the API key or, failing that, the bearer token in the
+// authorization value and stores the caller in ctx. Requests without
+// credentials, or any request with authentication disabled, keep ctx as is.
+func (app *application) identify(ctx context.Context, key, authorization string) (context.Context, error) {
+	if !app.authEnabled {
+		return ctx, nil
+	}
+
+	if key != "" {
+		apiKey, err := app.apiKeys.Authenticate(ctx, key)
+		if err != nil {
+			if errors.Is(err, models.ErrNoRecord) {
+				return ctx, errInvalidAPIKey
+			}
+			return ctx, err
+		}
+
+		return context.WithValue(ctx, apiKeyContextKey, apiKey), nil
+	}
+
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || app.jwt == nil {
+		return ctx, nil
+	}
+
+	identity, err := app.jwt.Verify(token)
+	if err == nil && !identity.Admin {
+		// Regular users are matched against subscriptions.user_id.
+		_, err = uuid.Parse(identity.Subject)
+	}
+	if err != nil {
+		return ctx, errInvalidToken
+	}
+
+	return context.WithValue(ctx, identityContextKey, identity), nil
+}
+
+func (app *application) requireScope(scope string) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch app.checkScope(r.Context(), scope) {
+			case errUnauthenticated:
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			case errForbidden:
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// requireAuthentication rejects anonymous requests to routes whose scopes are
+// checked further in, by the handler.
+func (app *application) requireAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.authEnabled && principal(r.Context()) == "" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var (
+	errUnauthenticated = errors.New("unauthenticated")
+	errForbidden       = errors.New("forbidden")
+)
+
+// checkScope returns errUnauthenticated if no caller is stored in ctx and
+// errForbidden if the caller lacks scope.
+func (app *application) checkScope(ctx context.Context, scope string) error {
+	if !app.authEnabled {
+		return nil
+	}
+
+	var allowed bool
+
+	if apiKey, ok := ctx.Value(apiKeyContextKey).(models.APIKey); ok {
+		allowed = apiKey.HasScope(scope)
+	} else if identity, ok := ctx.Value(identityContextKey).(auth.Identity); ok {
+		// Token holders get every scope but admin; regular users are
+		// limited to their own data by the handlers.
+		allowed = identity.Admin || scope != models.ScopeAdmin
+	} else {
+		return errUnauthenticated
+	}
+
+	if !allowed {
+		return errForbidden
+	}
+
+	return nil
+}
+
+var tenantIDRX = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// resolveTenant stores the tenant of the request in the context. The tenant
+// comes from the caller's API key or token; the X-Tenant-ID header may only
+// repeat it. Anonymous requests, which are possible with authentication
+// disabled, pick the tenant with the header.
+func (app *application) resolveTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := app.withTenant(r.Context(), r.Header.Get("X-Tenant-ID"))
+		switch {
+		case errors.Is(err, errInvalidTenant):
+			http.Error(w, "Invalid X-Tenant-ID format", http.StatusBadRequest)
+		case errors.Is(err, errForbidden):
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		default:
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+	})
+}
+
+var errInvalidTenant = errors.New("invalid tenant ID format")
+
+// withTenant stores the tenant of the caller in ctx. requested is the tenant
+// the client asked for, if any.
+func (app *application) withTenant(ctx context.Context, requested string) (context.Context, error) {
+	if requested != "" && !tenantIDRX.MatchString(requested) {
+		return ctx, errInvalidTenant
+	}
+
+	var (
+		tenantID      string
+		authenticated bool
+	)
+
+	if apiKey, ok := ctx.Value(apiKeyContextKey).(models.APIKey); ok {
+		tenantID, authenticated = apiKey.TenantID, true
+	} else if identity, ok := ctx.Value(identityContextKey).(auth.Identity); ok {
+		tenantID, authenticated = identity.TenantID, true
+	} else {
+		tenantID = requested
+	}
+
+	if tenantID == "" {
+		tenantID = app.defaultTenant
+	}
+
+	if authenticated && requested != "" && requested != tenantID {
+		return ctx, errForbidden
+	}
+
+	return context.WithValue(ctx, tenantContextKey, tenantID), nil
+}
+
+func (app *application) recordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			// An aborted response went out with a success status before the
+			// handler failed, so it is counted as a server error.
+			err := recover()
+			status := rw.status
+			if err != nil {
+				status = http.StatusInternalServerError
+			}
+			app.metrics.ObserveRequest(r.Pattern, r.Method, status, time.Since(start))
+			if err != nil {
+				panic(err)
+			}
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// responseWriter remembers the status code and the number of bytes written.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// routeReads sends reads of clients that ask for it with X-Read-Primary, or
+// that wrote within the sticky window, to the primary database, and starts
+// the window after a successful write.
+func (app *application) routeReads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := app.clientID(r)
+		r = r.WithContext(app.readContext(r))
+
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		if rw.status < http.StatusBadRequest {
+			app.sticky.wrote(client)
+		}
+	})
+}
+
+// readContext returns the context of r, marked for reads from the primary
+// database if the client asks for it or is within the sticky window.
+func (app *application) readContext(r *http.Request) context.Context {
+	primary, _ := strconv.ParseBool(r.Header.Get("X-Read-Primary"))
+	if primary || app.sticky.active(app.clientID(r)) {
+		return models.WithPrimary(r.Context())
+	}
+	return r.Context()
+}
+
+const (
+	rateLimitRead   = "read"
+	rateLimitWrite  = "write"
+	rateLimitReport = "report"
+)
+
+// rateLimit takes a token from the client's budget of the given class and
+// rejects the request with 429 when it is empty. Failures of the store let
+// the request through.
+func (app *application) rateLimit(class string) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if app.takeRateLimit(w, r, class) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// takeRateLimit is rateLimit for handlers that learn the class of a request
+// from its body. It reports whether the request may proceed; otherwise the
+// response has been sent.
+func (app *application) takeRateLimit(w http.ResponseWriter, r *http.Request, class string) bool {
+	limit, ok := app.rateLimits[class]
+	if !ok {
+		return true
+	}
+
+	res, err := app.rateLimiter.Take(r.Context(), class+"/"+app.clientID(r), limit)
+	if err != nil {
+		app.requestLogger(r).ErrorContext(r.Context(), "rate limit store failed", "error", err.Error())
+		return true
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+
+	if !res.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return false
+	}
+
+	return true
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// limitBody makes reading more than n bytes of the request body fail with
+// *http.MaxBytesError.
+func limitBody(n int64) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// cors allows browsers on the configured origins to read responses.
+func (app *application) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+
+		if origin := r.Header.Get("Origin"); origin != "" && app.corsOriginAllowed(origin) {
+			app.setCORSOrigin(w, origin)
+			if len(app.corsConfig.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(app.corsConfig.ExposedHeaders, ", "))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflight answers OPTIONS requests for every route registered on mux,
+// listing the methods the route supports.
+func (app *application) preflight(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var methods []string
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete} {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			if _, pattern := mux.Handler(probe); pattern != "" {
+				methods = append(methods, method)
+			}
+		}
+		if len(methods) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Allow", strings.Join(append(methods, http.MethodOptions), ", "))
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+		origin := r.Header.Get("Origin")
+		method := r.Header.Get("Access-Control-Request-Method")
+
+		if origin != "" && method != "" && app.corsOriginAllowed(origin) &&
+			slices.Contains(methods, method) && slices.Contains(app.corsConfig.AllowedMethods, method) {
+			app.setCORSOrigin(w, origin)
+
+			var allowed []string
+			for _, m := range methods {
+				if slices.Contains(app.corsConfig.AllowedMethods, m) {
+					allowed = append(allowed, m)
+				}
+			}
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowed, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(app.corsConfig.AllowedHeaders, ", "))
+			if app.corsConfig.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(app.corsConfig.MaxAge.Seconds())))
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (app *application) corsOriginAllowed(origin string) bool {
+	return slices.Contains(app.corsConfig.AllowedOrigins, "*") || slices.Contains(app.corsConfig.AllowedOrigins, origin)
+}
+
+func (app *application) setCORSOrigin(w http.ResponseWriter, origin string) {
+	if app.corsConfig.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	} else if slices.Contains(app.corsConfig.AllowedOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+}
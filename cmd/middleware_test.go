@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/edzh1/rest-effective-mobile/internal/config"
+	"github.com/justinas/alice"
+)
+
+// A response aborted after it started streaming reaches the client cut
+// short, even through compression.
+func TestAbortedResponseIsTruncated(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+	}{
+		{name: "Identity", acceptEncoding: "identity"},
+		{name: "Gzip", acceptEncoding: "gzip"},
+	}
+
+	app := newTestApplication(t)
+	app.compression = config.Compression{Enabled: true, MinSize: 1, Level: -1}
+
+	handler := app.recoverPanic(app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		io.WriteString(w, strings.Repeat("row\n", 1000))
+		http.NewResponseController(w).Flush()
+		panic(http.ErrAbortHandler)
+	})))
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+
+			res, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d; want %d", res.StatusCode, http.StatusOK)
+			}
+
+			_, err = io.ReadAll(res.Body)
+			if err == nil {
+				t.Error("got a complete body; want a read error")
+			}
+		})
+	}
+}
+
+// Aborted responses pass recoverPanic on their way to net/http, but are still
+// logged and counted, as a server error, on the way out.
+func TestAbortedResponseIsRecorded(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		wantLog     string
+		wantMetric  string
+		wantAborted bool
+	}{
+		{
+			name: "Aborted",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "row\n")
+				panic(http.ErrAbortHandler)
+			},
+			wantLog:     "status=200 bytes=4",
+			wantMetric:  `http_requests_total{method="GET",route="GET /export",status="500"} 1`,
+			wantAborted: true,
+		},
+		{
+			name: "Panicked",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			},
+			wantLog:    "status=500",
+			wantMetric: `http_requests_total{method="GET",route="GET /export",status="500"} 1`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs strings.Builder
+			app := newTestApplication(t)
+			app.logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+			mux := http.NewServeMux()
+			mux.Handle("GET /export", alice.New(app.recordMetrics, app.logRequest, app.recoverPanic).Then(tt.handler))
+
+			aborted := func() (aborted bool) {
+				defer func() {
+					aborted = recover() == http.ErrAbortHandler
+				}()
+				mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/export", nil))
+				return false
+			}()
+			if aborted != tt.wantAborted {
+				t.Errorf("got aborted %t; want %t", aborted, tt.wantAborted)
+			}
+
+			if !strings.Contains(logs.String(), "completed request") || !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("got logs %q; want a completed request with %q", logs.String(), tt.wantLog)
+			}
+
+			rr := httptest.NewRecorder()
+			app.metrics.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			if !strings.Contains(rr.Body.String(), tt.wantMetric) {
+				t.Errorf("got no %q in the metrics", tt.wantMetric)
+			}
+		})
+	}
+}
@@ -2,28 +2,115 @@ package main
 
 import (
 	"net/http"
-	"os"
+	"strings"
 
 	_ "github.com/edzh1/rest-effective-mobile/docs"
+	"github.com/edzh1/rest-effective-mobile/internal/models"
 	"github.com/justinas/alice"
 	httpSwagger "github.com/swaggo/http-swagger/v2"
 )
 
+// route is an endpoint of an API version. Its pattern is relative to the
+// version prefix.
+type route struct {
+	pattern string
+	handler http.Handler
+}
+
+// chains are the middleware chains shared by all API versions.
+type chains struct {
+	read      alice.Chain
+	export    alice.Chain
+	reports   alice.Chain
+	admin     alice.Chain
+	writeJSON alice.Chain
+	writeCSV  alice.Chain
+}
+
 func (app *application) routes() http.Handler {
 	mux := http.NewServeMux()
 
-	standard := alice.New(app.recoverPanic, app.logRequest, commonHeaders)
+	v1 := app.v1Routes(app.chains())
+
+	mount(mux, "/v1", v1)
+	// The unversioned paths are kept as aliases of v1 until the sunset.
+	mount(mux, "", v1, app.deprecated)
+
+	// GraphQL evolves its schema instead of being versioned. Its queries are
+	// POSTs too, so reads are routed, scopes checked and budgets charged by
+	// the handler, which knows whether an operation is a query or a mutation.
+	graphqlChain := app.baseChain().Append(app.requireAuthentication, limitBody(app.maxBodyBytes), app.idempotent)
+	mux.Handle("POST /graphql", graphqlChain.ThenFunc(app.graphqlQuery))
 
-	mux.Handle("POST /subscriptions", standard.ThenFunc(app.subscriptionCreate))
-	mux.Handle("GET /subscriptions", standard.ThenFunc(app.subscriptionViewList))
-	mux.Handle("GET /subscriptions/total", standard.ThenFunc(app.subscriptionTotal))
-	mux.Handle("GET /subscriptions/{id}", standard.ThenFunc(app.subscriptionView))
-	mux.Handle("PUT /subscriptions/{id}", standard.ThenFunc(app.subscriptionUpdate))
-	mux.Handle("DELETE /subscriptions/{id}", standard.ThenFunc(app.subscriptionDelete))
+	// Probes are hit every few seconds, so they skip request logging,
+	// tracing and metrics.
+	probe := alice.New(app.recoverPanic, app.commonHeaders)
 
-	if os.Getenv("ENV") == "dev" {
+	mux.Handle("GET /healthz", probe.ThenFunc(app.healthz))
+	mux.Handle("GET /readyz", probe.ThenFunc(app.readyz))
+
+	// Preflight requests carry no credentials, so they skip authentication.
+	preflight := alice.New(app.traceRequest, app.requestID, app.recordMetrics, app.logRequest, app.recoverPanic, app.commonHeaders)
+	mux.Handle("OPTIONS /", preflight.Then(app.preflight(mux)))
+
+	if app.swagger {
 		mux.HandleFunc("GET /swagger/", httpSwagger.WrapHandler)
 	}
 
 	return mux
 }
+
+// baseChain authenticates the caller and resolves the tenant of a request.
+func (app *application) baseChain() alice.Chain {
+	// compress sits outside of idempotent, so that stored responses are kept
+	// uncompressed and the encoding of replays is negotiated afresh.
+	return alice.New(app.traceRequest, app.requestID, app.recordMetrics, app.logRequest, app.recoverPanic, app.commonHeaders, app.compress, app.cors, app.authenticate, app.resolveTenant)
+}
+
+func (app *application) chains() chains {
+	standard := app.baseChain().Append(app.routeReads)
+
+	read := standard.Append(app.requireScope(models.ScopeSubscriptionsRead), app.rateLimit(rateLimitRead))
+	write := standard.Append(app.requireScope(models.ScopeSubscriptionsWrite), app.rateLimit(rateLimitWrite))
+
+	// Bodies are limited before idempotent reads them for hashing. An export
+	// dumps every matching row, so it is charged to the report budget.
+	return chains{
+		read:      read,
+		export:    standard.Append(app.requireScope(models.ScopeSubscriptionsRead), app.rateLimit(rateLimitReport)),
+		reports:   standard.Append(app.requireScope(models.ScopeReportsRead), app.rateLimit(rateLimitReport)),
+		admin:     standard.Append(app.requireScope(models.ScopeAdmin), limitBody(app.maxBodyBytes)),
+		writeJSON: write.Append(limitBody(app.maxBodyBytes), app.idempotent),
+		writeCSV:  write.Append(limitBody(app.maxImportBytes), app.idempotent),
+	}
+}
+
+// v1Routes lists the endpoints of the first API version. A later version
+// lists its own routes, reusing the handlers whose responses it keeps and
+// adding new ones where the shapes differ; the models are shared.
+func (app *application) v1Routes(c chains) []route {
+	return []route{
+		{"POST /subscriptions", c.writeJSON.ThenFunc(app.subscriptionCreate)},
+		{"GET /subscriptions", c.read.Append(app.negotiate).ThenFunc(app.subscriptionViewList)},
+		{"POST /subscriptions/import", c.writeCSV.ThenFunc(app.subscriptionImport)},
+		{"GET /subscriptions/export", c.export.ThenFunc(app.subscriptionExport)},
+		{"GET /subscriptions/total", c.reports.Append(app.negotiate).ThenFunc(app.subscriptionTotal)},
+		{"GET /subscriptions/{id}", c.read.Append(app.negotiate).ThenFunc(app.subscriptionView)},
+		{"PUT /subscriptions/{id}", c.writeJSON.ThenFunc(app.subscriptionUpdate)},
+		{"DELETE /subscriptions/{id}", c.writeJSON.ThenFunc(app.subscriptionDelete)},
+		{"GET /users/{user_id}/subscriptions/overlaps", c.reports.Append(app.negotiate).ThenFunc(app.userSubscriptionOverlaps)},
+
+		{"POST /api-keys", c.admin.ThenFunc(app.apiKeyCreate)},
+		{"GET /api-keys", c.admin.ThenFunc(app.apiKeyList)},
+		{"DELETE /api-keys/{id}", c.admin.ThenFunc(app.apiKeyRevoke)},
+	}
+}
+
+// mount registers routes under prefix, wrapping each of them with the given
+// middleware.
+func mount(mux *http.ServeMux, prefix string, routes []route, middleware ...alice.Constructor) {
+	for _, rt := range routes {
+		method, path, _ := strings.Cut(rt.pattern, " ")
+		mux.Handle(method+" "+prefix+path, alice.New(middleware...).Then(rt.handler))
+	}
+}
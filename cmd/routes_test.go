@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/edzh1/rest-effective-mobile/internal/config"
+	"github.com/edzh1/rest-effective-mobile/internal/ratelimit"
+)
+
+// Metrics label every tenant, so they are served on their own address only.
+func TestMetricsAreNotServedByTheAPI(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		want    int
+	}{
+		{name: "API", handler: app.routes(), want: http.StatusMethodNotAllowed},
+		{name: "Metrics server", handler: app.newMetricsServer(":9090", config.Server{}).Handler, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		tt.handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		if rr.Code != tt.want {
+			t.Errorf("%s: got status %d; want %d", tt.name, rr.Code, tt.want)
+		}
+	}
+}
+
+// An export dumps the whole table, so it is charged to the report budget,
+// whose single token allows one request, rather than the read budget.
+func TestExportRateLimitClass(t *testing.T) {
+	app := newTestApplication(t)
+	app.rateLimiter = ratelimit.NewMemoryStore()
+	app.rateLimits = map[string]ratelimit.Limit{
+		rateLimitRead:   {Rate: 0.001, Burst: 100},
+		rateLimitReport: {Rate: 0.001, Burst: 1},
+	}
+
+	var status int
+	for range 2 {
+		rr := httptest.NewRecorder()
+		app.routes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/subscriptions/export", nil))
+		status = rr.Code
+	}
+
+	if status != http.StatusTooManyRequests {
+		t.Errorf("got status %d; want %d", status, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/edzh1/rest-effective-mobile/internal/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+)
+
+// serve runs the HTTP server, and the gRPC and metrics servers if they have
+// an address, until the HTTP server fails or a termination signal arrives, in
+// which case all of them stop accepting connections and wait for in-flight
+// requests to complete.
+func (app *application) serve(addr string, cfg config.Server, grpcCfg config.GRPC, metricsCfg config.Metrics) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           app.routes(),
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+	}
+
+	var (
+		grpcSrv    *grpc.Server
+		grpcHealth *health.Server
+	)
+	if grpcCfg.Addr != "" {
+		grpcSrv, grpcHealth = app.newGRPCServer(grpcCfg)
+
+		lis, err := net.Listen("tcp", grpcCfg.Addr)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			app.logger.Info("starting gRPC server", "addr", grpcCfg.Addr)
+
+			err := grpcSrv.Serve(lis)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		}()
+	}
+
+	var metricsSrv *http.Server
+	if metricsCfg.Addr != "" {
+		metricsSrv = app.newMetricsServer(metricsCfg.Addr, cfg)
+
+		lis, err := net.Listen("tcp", metricsCfg.Addr)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			app.logger.Info("starting metrics server", "addr", metricsCfg.Addr)
+
+			err := metricsSrv.Serve(lis)
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.Error(err.Error())
+			}
+		}()
+	}
+
+	shutdownErr := make(chan error)
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		app.logger.Info("shutting down server", "signal", s.String())
+
+		// Fail readiness first so that no new traffic is routed here while
+		// in-flight requests drain.
+		app.shuttingDown.Store(true)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+
+		grpcStopped := make(chan struct{})
+		go func() {
+			defer close(grpcStopped)
+			if grpcSrv != nil {
+				grpcHealth.Shutdown()
+				stopGRPC(ctx, grpcSrv)
+			}
+		}()
+
+		err := srv.Shutdown(ctx)
+		<-grpcStopped
+
+		// Metrics keep being served while the API drains.
+		if metricsSrv != nil {
+			metricsSrv.Shutdown(ctx)
+		}
+
+		shutdownErr <- err
+	}()
+
+	app.logger.Info("starting server", "addr", addr)
+
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = <-shutdownErr
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("stopped server", "addr", addr)
+
+	return nil
+}
+
+// newMetricsServer serves Prometheus metrics. They are not exposed on the API
+// address because their labels reveal every tenant.
+func (app *application) newMetricsServer(addr string, cfg config.Server) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", app.metrics.Handler())
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+	}
+}
+
+// stopGRPC waits for in-flight calls to complete until ctx is done, then
+// cancels the remaining ones.
+func stopGRPC(ctx context.Context, srv *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		srv.Stop()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// stickyPrimary remembers clients that wrote recently, so that their reads
+// go to the primary until the replicas have caught up.
+type stickyPrimary struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	until     map[string]time.Time
+	lastPrune time.Time
+}
+
+func newStickyPrimary(window time.Duration) *stickyPrimary {
+	return &stickyPrimary{
+		window: window,
+		until:  make(map[string]time.Time),
+	}
+}
+
+func (s *stickyPrimary) wrote(client string) {
+	if s.window <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.until[client] = now.Add(s.window)
+
+	if now.Sub(s.lastPrune) > s.window {
+		for c, until := range s.until {
+			if now.After(until) {
+				delete(s.until, c)
+			}
+		}
+		s.lastPrune = now
+	}
+}
+
+func (s *stickyPrimary) active(client string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return time.Now().Before(s.until[client])
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/edzh1/rest-effective-mobile/internal/metrics"
+	"github.com/edzh1/rest-effective-mobile/internal/models"
+)
+
+// newTestApplication returns an application without a database. Handlers
+// that reach the models fail with ErrNoTenant, which serverError turns into
+// a 500.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	// The metrics only read the statistics of the pool, which never connects.
+	db, err := sql.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &application{
+		logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		subscriptions: &models.SubscriptionModel{},
+		maxPage:       100,
+		maxBodyBytes:  1 << 20,
+		sticky:        newStickyPrimary(0),
+		metrics: metrics.New(db, func() (map[string]int, error) {
+			return map[string]int{"default": 1}, nil
+		}, 0),
+	}
+}
+
+func newJSONRequest(t *testing.T, method, target, body string) *http.Request {
+	t.Helper()
+
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidToken = errors.New("auth: invalid token")
+
+type JWTConfig struct {
+	// HS256Secret enables HS256 tokens signed with this shared secret.
+	HS256Secret string
+	// RS256PublicKeyFile is a PEM encoded RSA public key for RS256 tokens.
+	RS256PublicKeyFile string
+	// JWKSFile is a local JSON Web Key Set with RSA keys for RS256 tokens,
+	// selected by the token's kid header.
+	JWKSFile  string
+	Issuer    string
+	Audience  string
+	AdminRole string
+}
+
+type Identity struct {
+	Subject  string
+	TenantID string
+	Admin    bool
+}
+
+type claims struct {
+	jwt.RegisteredClaims
+	TenantID string   `json:"tenant_id"`
+	Role     string   `json:"role"`
+	Roles    []string `json:"roles"`
+}
+
+type Verifier struct {
+	secret     []byte
+	rsaKey     *rsa.PublicKey
+	rsaKeys    map[string]*rsa.PublicKey
+	parser     *jwt.Parser
+	adminRole  string
+	algorithms []string
+}
+
+func NewVerifier(cfg JWTConfig) (*Verifier, error) {
+	v := &Verifier{
+		adminRole: cfg.AdminRole,
+		rsaKeys:   make(map[string]*rsa.PublicKey),
+	}
+
+	if cfg.HS256Secret != "" {
+		v.secret = []byte(cfg.HS256Secret)
+		v.algorithms = append(v.algorithms, jwt.SigningMethodHS256.Alg())
+	}
+
+	if cfg.RS256PublicKeyFile != "" {
+		data, err := os.ReadFile(cfg.RS256PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.rsaKey, err = jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.JWKSFile != "" {
+		err := v.loadJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v.rsaKey != nil || len(v.rsaKeys) > 0 {
+		v.algorithms = append(v.algorithms, jwt.SigningMethodRS256.Alg())
+	}
+
+	if len(v.algorithms) == 0 {
+		return nil, errors.New("auth: no JWT keys configured")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(v.algorithms),
+		jwt.WithExpirationRequired(),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+	v.parser = jwt.NewParser(opts...)
+
+	return v, nil
+}
+
+// Verify checks the token signature and standard claims and returns the
+// caller's identity.
+func (v *Verifier) Verify(token string) (Identity, error) {
+	var c claims
+
+	_, err := v.parser.ParseWithClaims(token, &c, v.key)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	if c.Subject == "" {
+		return Identity{}, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+
+	admin := v.adminRole != "" && (c.Role == v.adminRole || slices.Contains(c.Roles, v.adminRole))
+
+	return Identity{Subject: c.Subject, TenantID: c.TenantID, Admin: admin}, nil
+}
+
+func (v *Verifier) key(t *jwt.Token) (any, error) {
+	switch t.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		return v.secret, nil
+	case jwt.SigningMethodRS256.Alg():
+		if kid, ok := t.Header["kid"].(string); ok {
+			if key, ok := v.rsaKeys[kid]; ok {
+				return key, nil
+			}
+		}
+		if v.rsaKey != nil {
+			return v.rsaKey, nil
+		}
+		return nil, errors.New("unknown signing key")
+	}
+
+	return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+}
+
+func (v *Verifier) loadJWKS(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string   `json:"kty"`
+			Kid string   `json:"kid"`
+			Use string   `json:"use"`
+			N   string   `json:"n"`
+			E   string   `json:"e"`
+			X5c []string `json:"x5c"`
+		} `json:"keys"`
+	}
+
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return fmt.Errorf("auth: invalid JWKS file: %w", err)
+	}
+
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		key, err := parseRSAJWK(k.N, k.E, k.X5c)
+		if err != nil {
+			return fmt.Errorf("auth: invalid JWKS key %s: %w", k.Kid, err)
+		}
+
+		// Keys without a kid are used for tokens that don't name one.
+		if k.Kid == "" {
+			v.rsaKey = key
+			continue
+		}
+		v.rsaKeys[k.Kid] = key
+	}
+
+	return nil
+}
+
+func parseRSAJWK(n, e string, x5c []string) (*rsa.PublicKey, error) {
+	if n == "" && len(x5c) > 0 {
+		der, err := base64.StdEncoding.DecodeString(x5c[0])
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("certificate key is not RSA")
+		}
+		return key, nil
+	}
+
+	nBytes, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(new(big.Int).SetBytes(eBytes).Int64()),
+	}, nil
+}
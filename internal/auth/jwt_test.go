@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestVerifier(t *testing.T) {
+	dir := t.TempDir()
+
+	pemKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&pemKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	pemFile := filepath.Join(dir, "key.pem")
+	writeFile(t, pemFile, pemData)
+
+	jwks, err := json.Marshal(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "2025-01",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(jwksKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(jwksKey.E)).Bytes()),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(dir, "jwks.json")
+	writeFile(t, jwksFile, jwks)
+
+	hs256 := JWTConfig{HS256Secret: "secret", Issuer: "https://auth.example.com", Audience: "subscriptions", AdminRole: "admin"}
+	rs256 := JWTConfig{RS256PublicKeyFile: pemFile, AdminRole: "admin"}
+	jwksConfig := JWTConfig{JWKSFile: jwksFile, AdminRole: "admin"}
+
+	valid := func(extra jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub":       "a3509860-d66f-4be4-8984-0b7a15b8f10c",
+			"tenant_id": "acme",
+			"iss":       "https://auth.example.com",
+			"aud":       "subscriptions",
+			"exp":       time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		config  JWTConfig
+		token   string
+		want    Identity
+		wantErr bool
+	}{
+		{
+			name:   "HS256",
+			config: hs256,
+			token:  sign(t, jwt.SigningMethodHS256, nil, []byte("secret"), valid(nil)),
+			want:   Identity{Subject: "a3509860-d66f-4be4-8984-0b7a15b8f10c", TenantID: "acme"},
+		},
+		{
+			name:   "Admin role",
+			config: hs256,
+			token:  sign(t, jwt.SigningMethodHS256, nil, []byte("secret"), valid(jwt.MapClaims{"roles": []string{"viewer", "admin"}})),
+			want:   Identity{Subject: "a3509860-d66f-4be4-8984-0b7a15b8f10c", TenantID: "acme", Admin: true},
+		},
+		{
+			name:    "Wrong secret",
+			config:  hs256,
+			token:   sign(t, jwt.SigningMethodHS256, nil, []byte("other"), valid(nil)),
+			wantErr: true,
+		},
+		{
+			name:    "Expired",
+			config:  hs256,
+			token:   sign(t, jwt.SigningMethodHS256, nil, []byte("secret"), valid(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})),
+			wantErr: true,
+		},
+		{
+			name:    "Without expiry",
+			config:  hs256,
+			token:   sign(t, jwt.SigningMethodHS256, nil, []byte("secret"), valid(jwt.MapClaims{"exp": nil})),
+			wantErr: true,
+		},
+		{
+			name:    "Without subject",
+			config:  hs256,
+			token:   sign(t, jwt.SigningMethodHS256, nil, []byte("secret"), valid(jwt.MapClaims{"sub": nil})),
+			wantErr: true,
+		},
+		{
+			name:    "Wrong issuer",
+			config:  hs256,
+			token:   sign(t, jwt.SigningMethodHS256, nil, []byte("secret"), valid(jwt.MapClaims{"iss": "https://evil.example.com"})),
+			wantErr: true,
+		},
+		{
+			name:    "Wrong audience",
+			config:  hs256,
+			token:   sign(t, jwt.SigningMethodHS256, nil, []byte("secret"), valid(jwt.MapClaims{"aud": "billing"})),
+			wantErr: true,
+		},
+		{
+			name:    "Algorithm not configured",
+			config:  hs256,
+			token:   sign(t, jwt.SigningMethodHS384, nil, []byte("secret"), valid(nil)),
+			wantErr: true,
+		},
+		{
+			name:    "Unsigned",
+			config:  hs256,
+			token:   sign(t, jwt.SigningMethodNone, nil, jwt.UnsafeAllowNoneSignatureType, valid(nil)),
+			wantErr: true,
+		},
+		{
+			name:   "RS256",
+			config: rs256,
+			token:  sign(t, jwt.SigningMethodRS256, nil, pemKey, valid(nil)),
+			want:   Identity{Subject: "a3509860-d66f-4be4-8984-0b7a15b8f10c", TenantID: "acme"},
+		},
+		{
+			// The public key must not be usable as an HMAC secret.
+			name:    "HS256 signed with the RS256 public key",
+			config:  rs256,
+			token:   sign(t, jwt.SigningMethodHS256, nil, pemData, valid(nil)),
+			wantErr: true,
+		},
+		{
+			name:    "RS256 signed with another key",
+			config:  rs256,
+			token:   sign(t, jwt.SigningMethodRS256, nil, jwksKey, valid(nil)),
+			wantErr: true,
+		},
+		{
+			name:   "JWKS",
+			config: jwksConfig,
+			token:  sign(t, jwt.SigningMethodRS256, map[string]any{"kid": "2025-01"}, jwksKey, valid(nil)),
+			want:   Identity{Subject: "a3509860-d66f-4be4-8984-0b7a15b8f10c", TenantID: "acme"},
+		},
+		{
+			name:    "JWKS unknown kid",
+			config:  jwksConfig,
+			token:   sign(t, jwt.SigningMethodRS256, map[string]any{"kid": "2024-12"}, jwksKey, valid(nil)),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		v, err := NewVerifier(tt.config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		identity, err := v.Verify(tt.token)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("%s: got error %v; want ErrInvalidToken", tt.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if identity != tt.want {
+			t.Errorf("%s: got %+v; want %+v", tt.name, identity, tt.want)
+		}
+	}
+}
+
+func TestNewVerifierWithoutKeys(t *testing.T) {
+	_, err := NewVerifier(JWTConfig{AdminRole: "admin"})
+	if err == nil {
+		t.Error("got no error; want one")
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, header map[string]any, key any, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	for k, v := range header {
+		token.Header[k] = v
+	}
+
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+
+	err := os.WriteFile(name, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,713 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Addr string `yaml:"addr"`
+	// Env is "dev", "staging" or "prod". Swagger UI is served in dev.
+	Env string `yaml:"env"`
+
+	Log           Log           `yaml:"log"`
+	DB            DB            `yaml:"db"`
+	Server        Server        `yaml:"server"`
+	GRPC          GRPC          `yaml:"grpc"`
+	GraphQL       GraphQL       `yaml:"graphql"`
+	QueryTimeouts QueryTimeouts `yaml:"query_timeouts"`
+	Idempotency   Idempotency   `yaml:"idempotency"`
+	Subscriptions Subscriptions `yaml:"subscriptions"`
+	Auth          Auth          `yaml:"auth"`
+	Tenancy       Tenancy       `yaml:"tenancy"`
+	Tracing       Tracing       `yaml:"tracing"`
+	Features      Features      `yaml:"features"`
+	RateLimit     RateLimit     `yaml:"rate_limit"`
+	CORS          CORS          `yaml:"cors"`
+	Headers       Headers       `yaml:"headers"`
+	Compression   Compression   `yaml:"compression"`
+	ReportCache   ReportCache   `yaml:"report_cache"`
+	Metrics       Metrics       `yaml:"metrics"`
+	Unversioned   Unversioned   `yaml:"unversioned"`
+}
+
+type Log struct {
+	// Level is "debug", "info", "warn" or "error".
+	Level string `yaml:"level"`
+	// Format is "json" or "text".
+	Format string `yaml:"format"`
+}
+
+type DB struct {
+	// URL is a complete connection string. When set, the connection fields
+	// from Host to SSLKey are ignored.
+	URL      string `yaml:"url"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	// SSLMode is disable, require, verify-ca or verify-full.
+	SSLMode     string `yaml:"sslmode"`
+	SSLRootCert string `yaml:"sslrootcert"`
+	SSLCert     string `yaml:"sslcert"`
+	SSLKey      string `yaml:"sslkey"`
+
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+	// ConnectTimeout is how long startup keeps retrying to reach the
+	// database.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+
+	// Replicas are connection URLs of read replicas serving subscription
+	// reads. They share the pool settings of the primary.
+	Replicas             []string      `yaml:"replicas"`
+	ReplicaCheckInterval time.Duration `yaml:"replica_check_interval"`
+	// ReplicaStickyWindow is how long a client's reads go to the primary
+	// after it wrote something, so that it sees its own writes.
+	ReplicaStickyWindow time.Duration `yaml:"replica_sticky_window"`
+}
+
+type Server struct {
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	// ExportWriteTimeout replaces WriteTimeout for streaming exports, which
+	// may take much longer. Zero means no limit.
+	ExportWriteTimeout time.Duration `yaml:"export_write_timeout"`
+	IdleTimeout        time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// after SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// MaxBodyBytes limits JSON request bodies, MaxImportBytes CSV imports.
+	MaxBodyBytes   int `yaml:"max_body_bytes"`
+	MaxImportBytes int `yaml:"max_import_bytes"`
+}
+
+type GRPC struct {
+	// Addr is where the gRPC API listens. Empty disables it.
+	Addr string `yaml:"addr"`
+	// Reflection lets clients such as grpcurl discover the services.
+	Reflection bool `yaml:"reflection"`
+}
+
+// GraphQL limits the queries accepted by /graphql before they run.
+type GraphQL struct {
+	// MaxDepth is how deeply selections may be nested.
+	MaxDepth int `yaml:"max_depth"`
+	// MaxComplexity bounds the number of fields a query may resolve, with
+	// list fields counted once per requested item.
+	MaxComplexity int `yaml:"max_complexity"`
+}
+
+type QueryTimeouts struct {
+	Read   time.Duration `yaml:"read"`
+	Write  time.Duration `yaml:"write"`
+	Report time.Duration `yaml:"report"`
+	Export time.Duration `yaml:"export"`
+}
+
+type Idempotency struct {
+	TTL time.Duration `yaml:"ttl"`
+	// CleanupInterval is how often expired keys are deleted.
+	CleanupInterval time.Duration `yaml:"cleanup_interval"`
+}
+
+type Subscriptions struct {
+	// OverlapPolicy is "reject" or "warn".
+	OverlapPolicy string `yaml:"overlap_policy"`
+	PageSize      int    `yaml:"page_size"`
+	MaxPage       int    `yaml:"max_page"`
+}
+
+type Auth struct {
+	Enabled bool `yaml:"enabled"`
+	JWT     JWT  `yaml:"jwt"`
+}
+
+type JWT struct {
+	HS256Secret        string `yaml:"hs256_secret"`
+	RS256PublicKeyFile string `yaml:"rs256_public_key_file"`
+	JWKSFile           string `yaml:"jwks_file"`
+	Issuer             string `yaml:"issuer"`
+	Audience           string `yaml:"audience"`
+	AdminRole          string `yaml:"admin_role"`
+}
+
+type Tenancy struct {
+	Default string `yaml:"default"`
+	RLS     bool   `yaml:"rls"`
+}
+
+type Tracing struct {
+	Exporter    string  `yaml:"exporter"`
+	Endpoint    string  `yaml:"endpoint"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+type RateLimit struct {
+	Enabled bool            `yaml:"enabled"`
+	Read    RateLimitBudget `yaml:"read"`
+	Write   RateLimitBudget `yaml:"write"`
+	Report  RateLimitBudget `yaml:"report"`
+	// TrustedProxies are addresses or CIDR ranges of proxies whose
+	// X-Forwarded-For header is used to find the client IP.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// RateLimitBudget allows Burst requests at once, refilled at
+// RequestsPerMinute.
+type RateLimitBudget struct {
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	Burst             int `yaml:"burst"`
+}
+
+type CORS struct {
+	// AllowedOrigins are origins allowed to call the API from a browser,
+	// "*" for any. CORS is disabled when empty.
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	ExposedHeaders   []string      `yaml:"exposed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// Headers are security headers added to every API response. Empty values
+// leave the header out.
+type Headers struct {
+	ContentSecurityPolicy string `yaml:"content_security_policy"`
+	FrameOptions          string `yaml:"frame_options"`
+}
+
+type Compression struct {
+	Enabled bool `yaml:"enabled"`
+	// MinSize is the smallest response in bytes that gets compressed.
+	MinSize int `yaml:"min_size"`
+	// Level is a compress/flate level from 1 (fastest) to 9 (best), or -1
+	// for the default.
+	Level int `yaml:"level"`
+}
+
+// ReportCache keeps totals and reports in memory until a subscription of the
+// tenant changes.
+type ReportCache struct {
+	// TTL bounds how long a result is kept, which matters for writes made
+	// by other instances. Zero disables the cache.
+	TTL time.Duration `yaml:"ttl"`
+	// MaxAge is sent in Cache-Control of report responses.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+type Metrics struct {
+	// Addr is where Prometheus metrics are served, apart from the API since
+	// they cover every tenant. Empty disables them.
+	Addr string `yaml:"addr"`
+	// ActiveInterval is how long the count of active subscriptions is
+	// reused across scrapes. Zero counts them on every scrape.
+	ActiveInterval time.Duration `yaml:"active_interval"`
+}
+
+// Unversioned describes the retirement of the API paths without a version
+// prefix. Dates are YYYY-MM-DD; an empty date leaves its header out.
+type Unversioned struct {
+	DeprecatedAt string `yaml:"deprecated_at"`
+	Sunset       string `yaml:"sunset"`
+}
+
+type Features struct {
+	// Swagger serves Swagger UI outside of dev as well.
+	Swagger bool `yaml:"swagger"`
+}
+
+func Default() Config {
+	return Config{
+		Addr: ":3000",
+		Env:  "prod",
+		Log: Log{
+			Level:  "info",
+			Format: "json",
+		},
+		DB: DB{
+			Host:            "localhost",
+			Port:            5432,
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+			ConnectTimeout:  time.Minute,
+
+			ReplicaCheckInterval: 10 * time.Second,
+			ReplicaStickyWindow:  5 * time.Second,
+		},
+		Server: Server{
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      60 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+			MaxBodyBytes:      1 << 20,
+			MaxImportBytes:    32 << 20,
+		},
+		GRPC: GRPC{
+			Addr:       ":3001",
+			Reflection: true,
+		},
+		GraphQL: GraphQL{
+			MaxDepth:      8,
+			MaxComplexity: 1000,
+		},
+		QueryTimeouts: QueryTimeouts{
+			Read:   5 * time.Second,
+			Write:  5 * time.Second,
+			Report: 30 * time.Second,
+		},
+		Idempotency: Idempotency{
+			TTL:             24 * time.Hour,
+			CleanupInterval: time.Hour,
+		},
+		Subscriptions: Subscriptions{
+			OverlapPolicy: "reject",
+			PageSize:      20,
+			MaxPage:       100,
+		},
+		Auth: Auth{
+			Enabled: true,
+			JWT: JWT{
+				AdminRole: "admin",
+			},
+		},
+		Tenancy: Tenancy{
+			Default: "default",
+		},
+		Tracing: Tracing{
+			SampleRatio: 1,
+		},
+		RateLimit: RateLimit{
+			Enabled: true,
+			Read:    RateLimitBudget{RequestsPerMinute: 600, Burst: 100},
+			Write:   RateLimitBudget{RequestsPerMinute: 120, Burst: 20},
+			Report:  RateLimitBudget{RequestsPerMinute: 30, Burst: 5},
+		},
+		CORS: CORS{
+			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+			AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "Idempotency-Key", "If-None-Match", "X-API-Key", "X-Read-Primary", "X-Request-ID", "X-Tenant-ID"},
+			ExposedHeaders: []string{"Deprecation", "ETag", "Idempotent-Replayed", "Link", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "Sunset", "Warning", "X-Request-ID"},
+			MaxAge:         10 * time.Minute,
+		},
+		Headers: Headers{
+			ContentSecurityPolicy: "default-src 'none'; frame-ancestors 'none'",
+			FrameOptions:          "deny",
+		},
+		Compression: Compression{
+			Enabled: true,
+			MinSize: 1024,
+			Level:   -1,
+		},
+		ReportCache: ReportCache{
+			TTL:    30 * time.Second,
+			MaxAge: 5 * time.Second,
+		},
+		Metrics: Metrics{
+			Addr:           ":9090",
+			ActiveInterval: time.Minute,
+		},
+		Unversioned: Unversioned{
+			DeprecatedAt: "2026-10-19",
+			Sunset:       "2027-04-19",
+		},
+	}
+}
+
+// binding ties a setting to its environment variable and command-line flag.
+type binding struct {
+	env    string
+	flag   string
+	usage  string
+	isBool bool
+	set    func(string) error
+}
+
+func (c *Config) bindings() []binding {
+	return []binding{
+		stringBinding(&c.Addr, "ADDR", "addr", "HTTP listen address"),
+		stringBinding(&c.Env, "ENV", "env", "Environment: dev, staging or prod"),
+		stringBinding(&c.Log.Level, "LOG_LEVEL", "log-level", "Log level: debug, info, warn or error"),
+		stringBinding(&c.Log.Format, "LOG_FORMAT", "log-format", "Log format: json or text"),
+
+		stringBinding(&c.DB.URL, "DATABASE_URL", "db-url", "PostgreSQL connection URL, overrides the other connection settings"),
+		stringBinding(&c.DB.Host, "POSTGRES_HOST", "db-host", "PostgreSQL host"),
+		intBinding(&c.DB.Port, "POSTGRES_PORT", "db-port", "PostgreSQL port"),
+		stringBinding(&c.DB.User, "POSTGRES_USER", "db-user", "PostgreSQL user"),
+		stringBinding(&c.DB.Password, "POSTGRES_PASSWORD", "db-password", "PostgreSQL password"),
+		stringBinding(&c.DB.Name, "POSTGRES_DB", "db-name", "PostgreSQL database"),
+		stringBinding(&c.DB.SSLMode, "POSTGRES_SSLMODE", "db-sslmode", "SSL mode: disable, require, verify-ca or verify-full"),
+		stringBinding(&c.DB.SSLRootCert, "POSTGRES_SSLROOTCERT", "db-sslrootcert", "CA certificate file for verify-ca and verify-full"),
+		stringBinding(&c.DB.SSLCert, "POSTGRES_SSLCERT", "db-sslcert", "Client certificate file"),
+		stringBinding(&c.DB.SSLKey, "POSTGRES_SSLKEY", "db-sslkey", "Client private key file"),
+		intBinding(&c.DB.MaxOpenConns, "DB_MAX_OPEN_CONNS", "db-max-open-conns", "Maximum open connections, 0 for no limit"),
+		intBinding(&c.DB.MaxIdleConns, "DB_MAX_IDLE_CONNS", "db-max-idle-conns", "Maximum idle connections"),
+		durationBinding(&c.DB.ConnMaxLifetime, "DB_CONN_MAX_LIFETIME", "db-conn-max-lifetime", "Maximum connection lifetime, 0 for no limit"),
+		durationBinding(&c.DB.ConnMaxIdleTime, "DB_CONN_MAX_IDLE_TIME", "db-conn-max-idle-time", "Maximum connection idle time, 0 for no limit"),
+		durationBinding(&c.DB.ConnectTimeout, "DB_CONNECT_TIMEOUT", "db-connect-timeout", "How long to retry connecting on startup, 0 for a single attempt"),
+		listBinding(&c.DB.Replicas, "DB_REPLICAS", "db-replicas", "Comma-separated connection URLs of read replicas"),
+		durationBinding(&c.DB.ReplicaCheckInterval, "DB_REPLICA_CHECK_INTERVAL", "db-replica-check-interval", "How often read replicas are health checked"),
+		durationBinding(&c.DB.ReplicaStickyWindow, "DB_REPLICA_STICKY_WINDOW", "db-replica-sticky-window", "How long reads go to the primary after a client's write"),
+
+		durationBinding(&c.Server.ReadTimeout, "SERVER_READ_TIMEOUT", "server-read-timeout", "HTTP read timeout"),
+		durationBinding(&c.Server.ReadHeaderTimeout, "SERVER_READ_HEADER_TIMEOUT", "server-read-header-timeout", "HTTP header read timeout"),
+		durationBinding(&c.Server.WriteTimeout, "SERVER_WRITE_TIMEOUT", "server-write-timeout", "HTTP write timeout"),
+		durationBinding(&c.Server.ExportWriteTimeout, "SERVER_EXPORT_WRITE_TIMEOUT", "server-export-write-timeout", "HTTP write timeout of exports, 0 for none"),
+		durationBinding(&c.Server.IdleTimeout, "SERVER_IDLE_TIMEOUT", "server-idle-timeout", "HTTP keep-alive idle timeout"),
+		durationBinding(&c.Server.ShutdownTimeout, "SHUTDOWN_TIMEOUT", "shutdown-timeout", "Grace period for in-flight requests on shutdown"),
+		intBinding(&c.Server.MaxBodyBytes, "MAX_BODY_BYTES", "max-body-bytes", "Maximum size of JSON request bodies"),
+		intBinding(&c.Server.MaxImportBytes, "MAX_IMPORT_BYTES", "max-import-bytes", "Maximum size of CSV imports"),
+
+		stringBinding(&c.GRPC.Addr, "GRPC_ADDR", "grpc-addr", "gRPC API address, empty to disable"),
+		boolBinding(&c.GRPC.Reflection, "GRPC_REFLECTION", "grpc-reflection", "Serve gRPC reflection"),
+
+		intBinding(&c.GraphQL.MaxDepth, "GRAPHQL_MAX_DEPTH", "graphql-max-depth", "Deepest selection nesting allowed in GraphQL queries"),
+		intBinding(&c.GraphQL.MaxComplexity, "GRAPHQL_MAX_COMPLEXITY", "graphql-max-complexity", "Highest complexity allowed for GraphQL queries"),
+
+		durationBinding(&c.QueryTimeouts.Read, "QUERY_TIMEOUT_READ", "query-timeout-read", "Timeout of read queries, 0 for none"),
+		durationBinding(&c.QueryTimeouts.Write, "QUERY_TIMEOUT_WRITE", "query-timeout-write", "Timeout of write queries, 0 for none"),
+		durationBinding(&c.QueryTimeouts.Report, "QUERY_TIMEOUT_REPORT", "query-timeout-report", "Timeout of report queries, 0 for none"),
+		durationBinding(&c.QueryTimeouts.Export, "QUERY_TIMEOUT_EXPORT", "query-timeout-export", "Timeout of export queries, 0 for none"),
+
+		durationBinding(&c.Idempotency.TTL, "IDEMPOTENCY_TTL", "idempotency-ttl", "How long idempotency keys are kept"),
+		durationBinding(&c.Idempotency.CleanupInterval, "IDEMPOTENCY_CLEANUP_INTERVAL", "idempotency-cleanup-interval", "How often expired idempotency keys are deleted"),
+
+		stringBinding(&c.Subscriptions.OverlapPolicy, "OVERLAP_POLICY", "overlap-policy", "Overlapping subscriptions policy: reject or warn"),
+		intBinding(&c.Subscriptions.PageSize, "PAGE_SIZE", "page-size", "Subscriptions per page"),
+		intBinding(&c.Subscriptions.MaxPage, "MAX_PAGE", "max-page", "Highest page number that may be requested"),
+
+		boolBinding(&c.Auth.Enabled, "AUTH_ENABLED", "auth-enabled", "Require API keys or JWTs"),
+		stringBinding(&c.Auth.JWT.HS256Secret, "JWT_HS256_SECRET", "jwt-hs256-secret", "Shared secret of HS256 JWTs"),
+		stringBinding(&c.Auth.JWT.RS256PublicKeyFile, "JWT_RS256_PUBLIC_KEY_FILE", "jwt-rs256-public-key-file", "PEM public key of RS256 JWTs"),
+		stringBinding(&c.Auth.JWT.JWKSFile, "JWT_JWKS_FILE", "jwt-jwks-file", "JWKS file with keys of RS256 JWTs"),
+		stringBinding(&c.Auth.JWT.Issuer, "JWT_ISSUER", "jwt-issuer", "Required JWT issuer"),
+		stringBinding(&c.Auth.JWT.Audience, "JWT_AUDIENCE", "jwt-audience", "Required JWT audience"),
+		stringBinding(&c.Auth.JWT.AdminRole, "JWT_ADMIN_ROLE", "jwt-admin-role", "JWT role granting admin access"),
+
+		stringBinding(&c.Tenancy.Default, "DEFAULT_TENANT", "default-tenant", "Tenant of anonymous requests"),
+		boolBinding(&c.Tenancy.RLS, "TENANT_RLS", "tenant-rls", "Enforce tenant isolation with row-level security"),
+
+		stringBinding(&c.Tracing.Exporter, "TRACING_EXPORTER", "tracing-exporter", "Trace exporter: otlp, stdout or empty to disable"),
+		stringBinding(&c.Tracing.Endpoint, "TRACING_ENDPOINT", "tracing-endpoint", "OTLP/HTTP collector URL"),
+		floatBinding(&c.Tracing.SampleRatio, "TRACING_SAMPLE_RATIO", "tracing-sample-ratio", "Share of traces to sample"),
+
+		boolBinding(&c.RateLimit.Enabled, "RATE_LIMIT_ENABLED", "rate-limit-enabled", "Limit requests per client"),
+		intBinding(&c.RateLimit.Read.RequestsPerMinute, "RATE_LIMIT_READ_RPM", "rate-limit-read-rpm", "Read requests per minute and client"),
+		intBinding(&c.RateLimit.Read.Burst, "RATE_LIMIT_READ_BURST", "rate-limit-read-burst", "Read requests a client may make at once"),
+		intBinding(&c.RateLimit.Write.RequestsPerMinute, "RATE_LIMIT_WRITE_RPM", "rate-limit-write-rpm", "Write requests per minute and client"),
+		intBinding(&c.RateLimit.Write.Burst, "RATE_LIMIT_WRITE_BURST", "rate-limit-write-burst", "Write requests a client may make at once"),
+		intBinding(&c.RateLimit.Report.RequestsPerMinute, "RATE_LIMIT_REPORT_RPM", "rate-limit-report-rpm", "Report requests per minute and client"),
+		intBinding(&c.RateLimit.Report.Burst, "RATE_LIMIT_REPORT_BURST", "rate-limit-report-burst", "Report requests a client may make at once"),
+		listBinding(&c.RateLimit.TrustedProxies, "TRUSTED_PROXIES", "trusted-proxies", "Comma-separated addresses or CIDR ranges of trusted proxies"),
+
+		listBinding(&c.CORS.AllowedOrigins, "CORS_ALLOWED_ORIGINS", "cors-allowed-origins", "Comma-separated origins allowed to call the API from browsers, * for any"),
+		listBinding(&c.CORS.AllowedMethods, "CORS_ALLOWED_METHODS", "cors-allowed-methods", "Comma-separated methods allowed in cross-origin requests"),
+		listBinding(&c.CORS.AllowedHeaders, "CORS_ALLOWED_HEADERS", "cors-allowed-headers", "Comma-separated request headers allowed in cross-origin requests"),
+		listBinding(&c.CORS.ExposedHeaders, "CORS_EXPOSED_HEADERS", "cors-exposed-headers", "Comma-separated response headers readable by cross-origin callers"),
+		boolBinding(&c.CORS.AllowCredentials, "CORS_ALLOW_CREDENTIALS", "cors-allow-credentials", "Allow cross-origin requests with credentials"),
+		durationBinding(&c.CORS.MaxAge, "CORS_MAX_AGE", "cors-max-age", "How long browsers may cache preflight responses"),
+		stringBinding(&c.Headers.ContentSecurityPolicy, "CONTENT_SECURITY_POLICY", "content-security-policy", "Content-Security-Policy header of API responses"),
+		stringBinding(&c.Headers.FrameOptions, "FRAME_OPTIONS", "frame-options", "X-Frame-Options header of API responses"),
+
+		boolBinding(&c.Compression.Enabled, "COMPRESSION_ENABLED", "compression-enabled", "Compress responses with gzip or deflate"),
+		intBinding(&c.Compression.MinSize, "COMPRESSION_MIN_SIZE", "compression-min-size", "Smallest response in bytes that gets compressed"),
+		intBinding(&c.Compression.Level, "COMPRESSION_LEVEL", "compression-level", "Compression level from 1 to 9, -1 for the default"),
+
+		durationBinding(&c.ReportCache.TTL, "REPORT_CACHE_TTL", "report-cache-ttl", "How long totals and reports are cached, 0 to disable"),
+		durationBinding(&c.ReportCache.MaxAge, "REPORT_CACHE_MAX_AGE", "report-cache-max-age", "Cache-Control max-age of totals and reports"),
+
+		stringBinding(&c.Metrics.Addr, "METRICS_ADDR", "metrics-addr", "Prometheus metrics listen address, empty to disable"),
+		durationBinding(&c.Metrics.ActiveInterval, "METRICS_ACTIVE_INTERVAL", "metrics-active-interval", "How long the count of active subscriptions is reused across scrapes"),
+
+		stringBinding(&c.Unversioned.DeprecatedAt, "UNVERSIONED_DEPRECATED_AT", "unversioned-deprecated-at", "Date the paths without /v1 were deprecated (YYYY-MM-DD)"),
+		stringBinding(&c.Unversioned.Sunset, "UNVERSIONED_SUNSET", "unversioned-sunset", "Date the paths without /v1 are removed (YYYY-MM-DD)"),
+
+		boolBinding(&c.Features.Swagger, "SWAGGER_ENABLED", "swagger", "Serve Swagger UI outside of dev"),
+	}
+}
+
+// Load builds the configuration from defaults, the YAML file named by the
+// -config flag or CONFIG_FILE, environment variables and flags, each
+// overriding the previous. Flags are registered on fs and parsed from args.
+// All invalid settings are reported in the returned error.
+func Load(fs *flag.FlagSet, args []string) (Config, error) {
+	cfg := Default()
+	bindings := cfg.bindings()
+
+	// Flags are collected first and applied last, so that they win over
+	// the file and the environment.
+	flagValues := make(map[string]string)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	for _, b := range bindings {
+		usage := fmt.Sprintf("%s (env %s)", b.usage, b.env)
+		record := func(s string) error {
+			flagValues[b.flag] = s
+			return nil
+		}
+		if b.isBool {
+			fs.BoolFunc(b.flag, usage, record)
+		} else {
+			fs.Func(b.flag, usage, record)
+		}
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+
+	if *configFile != "" {
+		err = cfg.loadFile(*configFile)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	var errs []error
+	for _, b := range bindings {
+		if value, ok := os.LookupEnv(b.env); ok {
+			err = b.set(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", b.env, err))
+			}
+		}
+	}
+	for _, b := range bindings {
+		if value, ok := flagValues[b.flag]; ok {
+			err = b.set(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", b.flag, err))
+			}
+		}
+	}
+	if err = cfg.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return cfg, errors.Join(errs...)
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+
+	err = dec.Decode(c)
+	if err != nil {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Addr != "", "addr must not be empty")
+	check(slices.Contains([]string{"dev", "staging", "prod"}, c.Env), "env must be dev, staging or prod, got %q", c.Env)
+	check(slices.Contains([]string{"debug", "info", "warn", "error"}, c.Log.Level), "log.level must be debug, info, warn or error, got %q", c.Log.Level)
+	check(slices.Contains([]string{"json", "text"}, c.Log.Format), "log.format must be json or text, got %q", c.Log.Format)
+
+	if c.DB.URL == "" {
+		check(c.DB.Host != "", "db.host must not be empty")
+		check(c.DB.Port > 0 && c.DB.Port < 65536, "db.port must be between 1 and 65535, got %d", c.DB.Port)
+		check(c.DB.User != "", "db.user must not be empty")
+		check(c.DB.Name != "", "db.name must not be empty")
+		check(slices.Contains([]string{"disable", "require", "verify-ca", "verify-full"}, c.DB.SSLMode), "db.sslmode must be disable, require, verify-ca or verify-full, got %q", c.DB.SSLMode)
+		check(c.DB.SSLRootCert != "" || !strings.HasPrefix(c.DB.SSLMode, "verify-"), "db.sslrootcert is required with sslmode %s", c.DB.SSLMode)
+		check((c.DB.SSLCert == "") == (c.DB.SSLKey == ""), "db.sslcert and db.sslkey must be set together")
+	}
+	check(c.DB.MaxOpenConns >= 0, "db.max_open_conns must not be negative")
+	check(c.DB.MaxIdleConns >= 0, "db.max_idle_conns must not be negative")
+	check(c.DB.MaxOpenConns == 0 || c.DB.MaxIdleConns <= c.DB.MaxOpenConns, "db.max_idle_conns must not exceed db.max_open_conns")
+	check(c.DB.ConnMaxLifetime >= 0, "db.conn_max_lifetime must not be negative")
+	check(c.DB.ConnMaxIdleTime >= 0, "db.conn_max_idle_time must not be negative")
+	check(c.DB.ConnectTimeout >= 0, "db.connect_timeout must not be negative")
+	check(len(c.DB.Replicas) == 0 || c.DB.ReplicaCheckInterval > 0, "db.replica_check_interval must be positive")
+	check(c.DB.ReplicaStickyWindow >= 0, "db.replica_sticky_window must not be negative")
+
+	check(c.Server.ReadTimeout > 0, "server.read_timeout must be positive")
+	check(c.Server.ReadHeaderTimeout > 0, "server.read_header_timeout must be positive")
+	check(c.Server.WriteTimeout > 0, "server.write_timeout must be positive")
+	check(c.Server.ExportWriteTimeout >= 0, "server.export_write_timeout must not be negative")
+	check(c.Server.IdleTimeout > 0, "server.idle_timeout must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Server.MaxBodyBytes > 0, "server.max_body_bytes must be positive")
+	check(c.Server.MaxImportBytes > 0, "server.max_import_bytes must be positive")
+
+	check(c.GraphQL.MaxDepth > 0, "graphql.max_depth must be positive")
+	check(c.GraphQL.MaxComplexity > 0, "graphql.max_complexity must be positive")
+
+	check(c.QueryTimeouts.Read >= 0, "query_timeouts.read must not be negative")
+	check(c.QueryTimeouts.Write >= 0, "query_timeouts.write must not be negative")
+	check(c.QueryTimeouts.Report >= 0, "query_timeouts.report must not be negative")
+	check(c.QueryTimeouts.Export >= 0, "query_timeouts.export must not be negative")
+
+	check(c.Idempotency.TTL > 0, "idempotency.ttl must be positive")
+	check(c.Idempotency.CleanupInterval > 0, "idempotency.cleanup_interval must be positive")
+
+	check(slices.Contains([]string{"reject", "warn"}, c.Subscriptions.OverlapPolicy), "subscriptions.overlap_policy must be reject or warn, got %q", c.Subscriptions.OverlapPolicy)
+	check(c.Subscriptions.PageSize > 0, "subscriptions.page_size must be positive")
+	check(c.Subscriptions.MaxPage > 0, "subscriptions.max_page must be positive")
+
+	check(c.Tenancy.Default != "", "tenancy.default must not be empty")
+
+	check(slices.Contains([]string{"", "otlp", "stdout"}, c.Tracing.Exporter), "tracing.exporter must be otlp, stdout or empty, got %q", c.Tracing.Exporter)
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+	budgets := []struct {
+		name   string
+		budget RateLimitBudget
+	}{
+		{"read", c.RateLimit.Read},
+		{"write", c.RateLimit.Write},
+		{"report", c.RateLimit.Report},
+	}
+	for _, b := range budgets {
+		check(b.budget.RequestsPerMinute > 0, "rate_limit.%s.requests_per_minute must be positive", b.name)
+		check(b.budget.Burst > 0, "rate_limit.%s.burst must be positive", b.name)
+	}
+	for _, proxy := range c.RateLimit.TrustedProxies {
+		_, err := ParseCIDR(proxy)
+		check(err == nil, "rate_limit.trusted_proxies: invalid address %q", proxy)
+	}
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		check(origin == "*" || strings.HasPrefix(origin, "http://") || strings.HasPrefix(origin, "https://"), "cors.allowed_origins: invalid origin %q", origin)
+	}
+	check(!c.CORS.AllowCredentials || !slices.Contains(c.CORS.AllowedOrigins, "*"), "cors.allow_credentials cannot be used with origin *")
+	check(c.CORS.MaxAge >= 0, "cors.max_age must not be negative")
+
+	check(c.Compression.MinSize >= 0, "compression.min_size must not be negative")
+	check(c.Compression.Level == -1 || (c.Compression.Level >= 1 && c.Compression.Level <= 9), "compression.level must be between 1 and 9 or -1")
+
+	check(c.ReportCache.TTL >= 0, "report_cache.ttl must not be negative")
+	check(c.ReportCache.MaxAge >= 0, "report_cache.max_age must not be negative")
+
+	check(c.Metrics.ActiveInterval >= 0, "metrics.active_interval must not be negative")
+
+	_, err := ParseDate(c.Unversioned.DeprecatedAt)
+	check(err == nil, "unversioned.deprecated_at must be a YYYY-MM-DD date, got %q", c.Unversioned.DeprecatedAt)
+	_, err = ParseDate(c.Unversioned.Sunset)
+	check(err == nil, "unversioned.sunset must be a YYYY-MM-DD date, got %q", c.Unversioned.Sunset)
+
+	return errors.Join(errs...)
+}
+
+// ParseDate parses a YYYY-MM-DD date. An empty string gives the zero time.
+func ParseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
+
+// ParseCIDR parses a CIDR range or a single IP address.
+func ParseCIDR(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// JWTEnabled reports whether any JWT signing key is configured.
+func (c Config) JWTEnabled() bool {
+	return c.Auth.JWT.HS256Secret != "" || c.Auth.JWT.RS256PublicKeyFile != "" || c.Auth.JWT.JWKSFile != ""
+}
+
+func stringBinding(p *string, env, flag, usage string) binding {
+	return binding{env: env, flag: flag, usage: usage, set: func(s string) error {
+		*p = s
+		return nil
+	}}
+}
+
+func listBinding(p *[]string, env, flag, usage string) binding {
+	return binding{env: env, flag: flag, usage: usage, set: func(s string) error {
+		var list []string
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+		*p = list
+		return nil
+	}}
+}
+
+func intBinding(p *int, env, flag, usage string) binding {
+	return binding{env: env, flag: flag, usage: usage, set: func(s string) error {
+		v, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		*p = v
+		return nil
+	}}
+}
+
+func floatBinding(p *float64, env, flag, usage string) binding {
+	return binding{env: env, flag: flag, usage: usage, set: func(s string) error {
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		*p = v
+		return nil
+	}}
+}
+
+func boolBinding(p *bool, env, flag, usage string) binding {
+	return binding{env: env, flag: flag, usage: usage, isBool: true, set: func(s string) error {
+		v, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		*p = v
+		return nil
+	}}
+}
+
+func durationBinding(p *time.Duration, env, flag, usage string) binding {
+	return binding{env: env, flag: flag, usage: usage, set: func(s string) error {
+		v, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*p = v
+		return nil
+	}}
+}
@@ -0,0 +1,188 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Settings are taken from the defaults, then the file, the environment and
+// the flags, each overriding the previous.
+func TestLoadPrecedence(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://localhost/subscriptions")
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(file, []byte(`
+addr: ":4000"
+grpc:
+  addr: ":4001"
+server:
+  write_timeout: 30s
+db:
+  replicas: ["postgres://file-replica/db"]
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		env              map[string]string
+		args             []string
+		wantAddr         string
+		wantGRPCAddr     string
+		wantWriteTimeout time.Duration
+		wantReplicas     []string
+	}{
+		{
+			name:             "Defaults",
+			wantAddr:         ":3000",
+			wantGRPCAddr:     ":3001",
+			wantWriteTimeout: time.Minute,
+		},
+		{
+			name:             "File",
+			args:             []string{"-config", file},
+			wantAddr:         ":4000",
+			wantGRPCAddr:     ":4001",
+			wantWriteTimeout: 30 * time.Second,
+			wantReplicas:     []string{"postgres://file-replica/db"},
+		},
+		{
+			name:             "File from the environment",
+			env:              map[string]string{"CONFIG_FILE": file},
+			wantAddr:         ":4000",
+			wantGRPCAddr:     ":4001",
+			wantWriteTimeout: 30 * time.Second,
+			wantReplicas:     []string{"postgres://file-replica/db"},
+		},
+		{
+			name:             "Environment over file",
+			env:              map[string]string{"ADDR": ":5000", "DB_REPLICAS": "postgres://a/db, postgres://b/db"},
+			args:             []string{"-config", file},
+			wantAddr:         ":5000",
+			wantGRPCAddr:     ":4001",
+			wantWriteTimeout: 30 * time.Second,
+			wantReplicas:     []string{"postgres://a/db", "postgres://b/db"},
+		},
+		{
+			name:             "Empty environment over file",
+			env:              map[string]string{"GRPC_ADDR": "", "DB_REPLICAS": ""},
+			args:             []string{"-config", file},
+			wantAddr:         ":4000",
+			wantWriteTimeout: 30 * time.Second,
+		},
+		{
+			name:             "Flags over environment",
+			env:              map[string]string{"ADDR": ":5000", "SERVER_WRITE_TIMEOUT": "90s"},
+			args:             []string{"-config", file, "-addr", ":6000"},
+			wantAddr:         ":6000",
+			wantGRPCAddr:     ":4001",
+			wantWriteTimeout: 90 * time.Second,
+			wantReplicas:     []string{"postgres://file-replica/db"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, tt.env, "CONFIG_FILE", "ADDR", "GRPC_ADDR", "SERVER_WRITE_TIMEOUT", "DB_REPLICAS")
+
+			cfg, err := Load(newFlagSet(), tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.Addr != tt.wantAddr {
+				t.Errorf("got addr %q; want %q", cfg.Addr, tt.wantAddr)
+			}
+			if cfg.GRPC.Addr != tt.wantGRPCAddr {
+				t.Errorf("got gRPC addr %q; want %q", cfg.GRPC.Addr, tt.wantGRPCAddr)
+			}
+			if cfg.Server.WriteTimeout != tt.wantWriteTimeout {
+				t.Errorf("got write timeout %s; want %s", cfg.Server.WriteTimeout, tt.wantWriteTimeout)
+			}
+			if !reflect.DeepEqual(cfg.DB.Replicas, tt.wantReplicas) {
+				t.Errorf("got replicas %q; want %q", cfg.DB.Replicas, tt.wantReplicas)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Setenv("DATABASE_URL", "postgres://localhost/subscriptions")
+
+	unknown := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(unknown, []byte("adress: \":4000\"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		wants []string
+	}{
+		{
+			name:  "Unknown file setting",
+			args:  []string{"-config", unknown},
+			wants: []string{"adress"},
+		},
+		{
+			name:  "Malformed environment value",
+			env:   map[string]string{"SERVER_WRITE_TIMEOUT": "soon"},
+			wants: []string{"SERVER_WRITE_TIMEOUT"},
+		},
+		{
+			name:  "Malformed flag value",
+			args:  []string{"-compression-level", "high"},
+			wants: []string{"-compression-level"},
+		},
+		{
+			name:  "Every invalid setting",
+			env:   map[string]string{"COMPRESSION_LEVEL": "12", "METRICS_ACTIVE_INTERVAL": "-1s"},
+			wants: []string{"compression.level", "metrics.active_interval"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, tt.env, "SERVER_WRITE_TIMEOUT", "COMPRESSION_LEVEL", "METRICS_ACTIVE_INTERVAL")
+
+			_, err := Load(newFlagSet(), tt.args)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			for _, want := range tt.wants {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("got error %q; want it to mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// setenv sets each key to its value in env and unsets the keys env lacks, so
+// an empty value stays distinguishable from an unset variable.
+func setenv(t *testing.T, env map[string]string, keys ...string) {
+	t.Helper()
+
+	for _, key := range keys {
+		value, ok := env[key]
+		t.Setenv(key, value)
+		if !ok {
+			os.Unsetenv(key)
+		}
+	}
+}
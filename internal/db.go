@@ -1,32 +1,134 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
 type DSN struct {
+	// URL is a complete connection string, either postgres:// URL or
+	// key=value pairs. When set, the fields below up to SSLKey are ignored.
+	URL string
+
 	Host     string
 	Port     int
 	User     string
 	Password string
 	DBname   string
+	// SSLMode is one of the libpq modes: disable, require, verify-ca or
+	// verify-full.
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// ConnectTimeout bounds the retries of the first connection. Zero means
+	// a single attempt.
+	ConnectTimeout time.Duration
+}
+
+func (cfg DSN) String() string {
+	if cfg.URL != "" {
+		return cfg.URL
+	}
+
+	params := []struct{ key, value string }{
+		{"host", cfg.Host},
+		{"port", fmt.Sprint(cfg.Port)},
+		{"user", cfg.User},
+		{"password", cfg.Password},
+		{"dbname", cfg.DBname},
+		{"sslmode", cfg.SSLMode},
+		{"sslrootcert", cfg.SSLRootCert},
+		{"sslcert", cfg.SSLCert},
+		{"sslkey", cfg.SSLKey},
+	}
+
+	var b strings.Builder
+	for _, p := range params {
+		if p.value == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(p.key + "=" + quoteDSNValue(p.value))
+	}
+
+	return b.String()
+}
+
+// quoteDSNValue quotes a value of a key=value connection string, so that
+// passwords and paths may contain spaces and quotes.
+func quoteDSNValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
 }
 
-func InitDB(cfg DSN) (*sql.DB, error) {
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.DBname)
-	db, err := sql.Open("postgres", psqlInfo)
+// OpenDB configures a connection pool without connecting to the database.
+func OpenDB(cfg DSN) (*sql.DB, error) {
+	db, err := sql.Open("postgres", cfg.String())
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.Ping()
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
+	return db, nil
+}
+
+// InitDB opens the connection pool and waits until the database answers,
+// retrying with exponential backoff for up to cfg.ConnectTimeout.
+func InitDB(cfg DSN, logger *slog.Logger) (*sql.DB, error) {
+	db, err := OpenDB(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	return db, nil
+	ctx := context.Background()
+	if cfg.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.ConnectTimeout)
+		defer cancel()
+	}
+
+	backoff := 500 * time.Millisecond
+	const maxBackoff = 10 * time.Second
+
+	for attempt := 1; ; attempt++ {
+		err = db.PingContext(ctx)
+		if err == nil {
+			return db, nil
+		}
+
+		deadline, ok := ctx.Deadline()
+		if !ok || time.Now().Add(backoff).After(deadline) {
+			db.Close()
+			return nil, fmt.Errorf("connecting to database after %d attempts: %w", attempt, err)
+		}
+
+		logger.Warn("database is not ready", "attempt", attempt, "retry_in", backoff, "error", err.Error())
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+
+		backoff = min(backoff*2, maxBackoff)
+	}
 }
@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	queryDuration   *prometheus.HistogramVec
+}
+
+// New registers the HTTP, query, connection pool and Go runtime metrics.
+// activeSubscriptions should return the number of active subscriptions per
+// tenant. It is called by a scrape at most once per activeInterval.
+func New(db *sql.DB, activeSubscriptions func() (map[string]int, error), activeInterval time.Duration) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of HTTP requests by route pattern, method and status code.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency by route pattern, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "db_query_duration_seconds",
+			Help:    "Duration of database queries by model method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db, "postgres"),
+		m.requests,
+		m.requestDuration,
+		m.queryDuration,
+		&activeCollector{
+			count:    activeSubscriptions,
+			interval: activeInterval,
+			desc: prometheus.NewDesc(
+				"subscriptions_active",
+				"Number of subscriptions active today by tenant.",
+				[]string{"tenant"}, nil,
+			),
+			errors: prometheus.NewDesc(
+				"subscriptions_active_scrape_errors",
+				"1 if the last count of active subscriptions failed.",
+				nil, nil,
+			),
+		},
+	)
+
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) ObserveRequest(route, method string, status int, duration time.Duration) {
+	code := strconv.Itoa(status)
+	m.requests.WithLabelValues(route, method, code).Inc()
+	m.requestDuration.WithLabelValues(route, method, code).Observe(duration.Seconds())
+}
+
+func (m *Metrics) ObserveQuery(method string, duration time.Duration) {
+	m.queryDuration.WithLabelValues(method).Observe(duration.Seconds())
+}
+
+// activeCollector queries the number of active subscriptions at scrape time,
+// reusing the last result for the interval.
+type activeCollector struct {
+	count    func() (map[string]int, error)
+	interval time.Duration
+	desc     *prometheus.Desc
+	errors   *prometheus.Desc
+
+	mu        sync.Mutex
+	countedAt time.Time
+	counts    map[string]int
+	err       error
+}
+
+func (c *activeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+	ch <- c.errors
+}
+
+func (c *activeCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := c.current()
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(c.errors, prometheus.GaugeValue, 1)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.errors, prometheus.GaugeValue, 0)
+
+	for tenant, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), tenant)
+	}
+}
+
+func (c *activeCollector) current() (map[string]int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.countedAt.IsZero() || time.Since(c.countedAt) >= c.interval {
+		c.counts, c.err = c.count()
+		c.countedAt = time.Now()
+	}
+
+	return c.counts, c.err
+}
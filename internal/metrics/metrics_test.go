@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The active subscriptions are counted at most once per interval, however
+// often Prometheus scrapes.
+func TestActiveCollectorInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		scrapes  int
+		want     int
+	}{
+		{name: "Every scrape", interval: 0, scrapes: 3, want: 3},
+		{name: "Within interval", interval: time.Hour, scrapes: 3, want: 1},
+	}
+
+	for _, tt := range tests {
+		var calls int
+		c := &activeCollector{
+			count: func() (map[string]int, error) {
+				calls++
+				return map[string]int{"default": 1}, nil
+			},
+			interval: tt.interval,
+			desc:     prometheus.NewDesc("subscriptions_active", "", []string{"tenant"}, nil),
+			errors:   prometheus.NewDesc("subscriptions_active_scrape_errors", "", nil, nil),
+		}
+
+		for range tt.scrapes {
+			ch := make(chan prometheus.Metric, 10)
+			c.Collect(ch)
+			close(ch)
+
+			var n int
+			for range ch {
+				n++
+			}
+			if n != 2 {
+				t.Errorf("%s: got %d metrics; want 2", tt.name, n)
+			}
+		}
+
+		if calls != tt.want {
+			t.Errorf("%s: got %d counts; want %d", tt.name, calls, tt.want)
+		}
+	}
+}
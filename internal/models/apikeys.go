@@ -0,0 +1,164 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	ScopeSubscriptionsRead  = "subscriptions:read"
+	ScopeSubscriptionsWrite = "subscriptions:write"
+	ScopeReportsRead        = "reports:read"
+	ScopeAdmin              = "admin"
+)
+
+var Scopes = []string{ScopeSubscriptionsRead, ScopeSubscriptionsWrite, ScopeReportsRead, ScopeAdmin}
+
+type APIKey struct {
+	ID        uuid.UUID  `json:"id"`
+	TenantID  string     `json:"tenant_id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// HasScope reports whether the key grants scope. The admin scope grants
+// everything.
+func (k APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+	// RowLevelSecurity binds the queries to the tenant, as it does for
+	// SubscriptionModel.
+	RowLevelSecurity bool
+}
+
+func hashAPIKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// Insert generates a new key and stores its hash. The plain key is returned
+// only here and cannot be recovered later.
+func (m *APIKeyModel) Insert(ctx context.Context, tenantID, name string, scopes []string, expiresAt *time.Time) (APIKey, string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := "sk_" + hex.EncodeToString(b)
+
+	k := APIKey{
+		TenantID:  tenantID,
+		Name:      name,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	stmt := `
+		INSERT INTO api_keys
+		(tenant_id, name, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+	err = inTenant(ctx, m.DB, m.RowLevelSecurity, tenantID, func(q querier) error {
+		return q.QueryRowContext(ctx, stmt, tenantID, name, hashAPIKey(key), pq.Array(scopes), expiresAt).Scan(&k.ID, &k.CreatedAt)
+	})
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	return k, key, nil
+}
+
+// Authenticate finds an active key. Unknown, expired and revoked keys all
+// result in ErrNoRecord. The tenant is not known yet, so the key is looked up
+// through a function that row level security does not apply to.
+func (m *APIKeyModel) Authenticate(ctx context.Context, key string) (APIKey, error) {
+	var k APIKey
+	stmt := `
+		SELECT id, tenant_id, name, scopes, created_at, expires_at, revoked_at
+		FROM api_key_by_hash($1)
+	`
+	row := m.DB.QueryRowContext(ctx, stmt, hashAPIKey(key))
+	err := row.Scan(&k.ID, &k.TenantID, &k.Name, pq.Array(&k.Scopes), &k.CreatedAt, &k.ExpiresAt, &k.RevokedAt)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIKey{}, ErrNoRecord
+		} else {
+			return APIKey{}, err
+		}
+	}
+
+	return k, nil
+}
+
+func (m *APIKeyModel) List(ctx context.Context, tenantID string) ([]APIKey, error) {
+	var keys []APIKey
+	stmt := `
+		SELECT id, tenant_id, name, scopes, created_at, expires_at, revoked_at
+		FROM api_keys
+		WHERE tenant_id = $1
+		ORDER BY created_at
+	`
+	err := inTenant(ctx, m.DB, m.RowLevelSecurity, tenantID, func(q querier) error {
+		rows, err := q.QueryContext(ctx, stmt, tenantID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var k APIKey
+			err = rows.Scan(&k.ID, &k.TenantID, &k.Name, pq.Array(&k.Scopes), &k.CreatedAt, &k.ExpiresAt, &k.RevokedAt)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (m *APIKeyModel) Revoke(ctx context.Context, tenantID string, id uuid.UUID) error {
+	stmt := `
+		UPDATE api_keys
+		SET revoked_at = now()
+		WHERE tenant_id = $1 AND id = $2 AND revoked_at IS NULL
+	`
+	var rows int64
+	err := inTenant(ctx, m.DB, m.RowLevelSecurity, tenantID, func(q querier) error {
+		result, err := q.ExecContext(ctx, stmt, tenantID, id)
+		if err != nil {
+			return err
+		}
+		rows, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
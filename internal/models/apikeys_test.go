@@ -0,0 +1,45 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAPIKeysUnderRowLevelSecurity(t *testing.T) {
+	db := newTestDB(t)
+	asServiceRole(t, db)
+
+	m := &APIKeyModel{DB: db, RowLevelSecurity: true}
+	ctx := context.Background()
+
+	acme, _, err := m.Insert(ctx, "acme", "ci", []string{ScopeSubscriptionsRead}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globex, globexKey, err := m.Insert(ctx, "globex", "ci", []string{ScopeAdmin}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := m.Authenticate(ctx, globexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.ID != globex.ID || k.TenantID != "globex" {
+		t.Errorf("got key %s of %s; want %s of globex", k.ID, k.TenantID, globex.ID)
+	}
+
+	keys, err := m.List(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].ID != acme.ID {
+		t.Errorf("got keys %v; want only %s", keys, acme.ID)
+	}
+
+	err = m.Revoke(ctx, "acme", globex.ID)
+	if !errors.Is(err, ErrNoRecord) {
+		t.Errorf("revoking a key of another tenant: got error %v; want ErrNoRecord", err)
+	}
+}
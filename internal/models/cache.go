@@ -0,0 +1,116 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReportCache keeps results of report queries per tenant until one of the
+// tenant's subscriptions changes or the entry expires. The expiry bounds how
+// stale a result can get through writes of other instances.
+type ReportCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	tenants map[string]*tenantCache
+}
+
+type tenantCache struct {
+	// generation changes on every write, so that results of queries that
+	// ran concurrently with the write are not stored.
+	generation uint64
+	entries    map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   any
+	expires time.Time
+}
+
+func NewReportCache(ttl time.Duration) *ReportCache {
+	return &ReportCache{
+		ttl:     ttl,
+		tenants: make(map[string]*tenantCache),
+	}
+}
+
+// lookup returns the cached value, if any, and the generation that a value
+// computed now must be stored with.
+func (c *ReportCache) lookup(tenantID, key string) (any, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.tenant(tenantID)
+	entry, ok := t.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(t.entries, key)
+		return nil, t.generation, false
+	}
+
+	return entry.value, t.generation, true
+}
+
+func (c *ReportCache) store(tenantID, key string, generation uint64, value any) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.tenant(tenantID)
+	if t.generation != generation {
+		return
+	}
+	t.entries[key] = cacheEntry{value: value, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *ReportCache) invalidate(tenantID string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.tenant(tenantID)
+	t.generation++
+	clear(t.entries)
+}
+
+func (c *ReportCache) tenant(tenantID string) *tenantCache {
+	t, ok := c.tenants[tenantID]
+	if !ok {
+		t = &tenantCache{entries: make(map[string]cacheEntry)}
+		c.tenants[tenantID] = t
+	}
+	return t
+}
+
+// cacheKey identifies the rows a filter selects. Pagination is left out, as
+// reports are not paginated.
+func (f SubscriptionFilter) cacheKey() string {
+	key := "user="
+	if f.UserID != nil {
+		key += f.UserID.String()
+	}
+	key += "|service="
+	if f.ServiceName != nil {
+		key += fmt.Sprintf("%q", strings.ToLower(*f.ServiceName))
+	}
+	key += "|start="
+	if f.StartDate != nil {
+		key += f.StartDate.Format(time.DateOnly)
+	}
+	key += "|end="
+	if f.EndDate != nil {
+		key += f.EndDate.Format(time.DateOnly)
+	}
+	return key
+}
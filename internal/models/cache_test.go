@@ -0,0 +1,57 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// With a cache, misses go to the primary, since a replica may lag behind the
+// write that invalidated the cache, and hits reach no database. Without one,
+// the replica serves every call.
+func TestCountTotalCache(t *testing.T) {
+	tests := []struct {
+		name        string
+		cache       *ReportCache
+		want        int
+		wantPrimary int64
+		wantReplica int64
+	}{
+		{name: "Cached", cache: NewReportCache(time.Minute), want: 100, wantPrimary: 1, wantReplica: 0},
+		{name: "Not cached", want: 50, wantPrimary: 0, wantReplica: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primaryDB, primary := newFakeDB(nil, int64(100))
+			replicaDB, replica := newFakeDB(nil, int64(50))
+
+			m := &SubscriptionModel{
+				DB:       primaryDB,
+				TenantID: "default",
+				Replicas: NewReplicas([]*sql.DB{replicaDB}, slog.New(slog.NewTextHandler(io.Discard, nil))),
+				Cache:    tt.cache,
+			}
+
+			for range 3 {
+				total, err := m.CountTotal(context.Background(), SubscriptionFilter{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if total != tt.want {
+					t.Errorf("got total %d; want %d", total, tt.want)
+				}
+			}
+
+			if got := primary.queries.Load(); got != tt.wantPrimary {
+				t.Errorf("got %d primary queries; want %d", got, tt.wantPrimary)
+			}
+			if got := replica.queries.Load(); got != tt.wantReplica {
+				t.Errorf("got %d replica queries; want %d", got, tt.wantReplica)
+			}
+		})
+	}
+}
@@ -1,5 +1,64 @@
 package models
 
-import "errors"
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/lib/pq"
+)
 
 var ErrNoRecord = errors.New("models: no matching record found")
+
+var ErrDuplicateRecord = errors.New("models: duplicate record")
+
+var ErrNoTenant = errors.New("models: tenant is not set")
+
+var ErrOverlap = errors.New("models: subscription overlaps with another one")
+
+// OverlapError is returned by writes that RejectOverlaps refused, with the
+// subscriptions the new period intersects. It matches ErrOverlap.
+type OverlapError struct {
+	Subscriptions []Subscription
+}
+
+func (e *OverlapError) Error() string {
+	return ErrOverlap.Error()
+}
+
+func (e *OverlapError) Is(target error) bool {
+	return target == ErrOverlap
+}
+
+var ErrTimeout = errors.New("models: query timed out")
+
+var ErrUnavailable = errors.New("models: database unavailable")
+
+// classifyError wraps err with ErrTimeout when the deadline of ctx was hit
+// and with ErrUnavailable when the database could not be reached.
+func classifyError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var (
+		pqErr  *pq.Error
+		netErr net.Error
+	)
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	case errors.Is(err, driver.ErrBadConn), errors.As(err, &netErr):
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	case errors.As(err, &pqErr):
+		// Connection exceptions, too_many_connections and cannot_connect_now.
+		if pqErr.Code.Class() == "08" || pqErr.Code == "53300" || pqErr.Code == "57P03" {
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+	}
+
+	return err
+}
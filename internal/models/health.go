@@ -0,0 +1,31 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+type HealthModel struct {
+	DB *sql.DB
+}
+
+func (m *HealthModel) Ping(ctx context.Context) error {
+	return classifyError(ctx, m.DB.PingContext(ctx))
+}
+
+// SchemaVersion returns the version of the last migration applied by goose.
+func (m *HealthModel) SchemaVersion(ctx context.Context) (int64, error) {
+	var version sql.NullInt64
+
+	stmt := `
+		SELECT max(version_id)
+		FROM goose_db_version
+		WHERE is_applied
+	`
+	err := m.DB.QueryRowContext(ctx, stmt).Scan(&version)
+	if err != nil {
+		return 0, classifyError(ctx, err)
+	}
+
+	return version.Int64, nil
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash []byte
+	Status      *int
+	ContentType *string
+	Body        []byte
+}
+
+type IdempotencyModel struct {
+	DB *sql.DB
+	// RowLevelSecurity binds the queries to the tenant, as it does for
+	// SubscriptionModel.
+	RowLevelSecurity bool
+}
+
+// Claim reserves key of the caller named by principal for a request with the
+// given hash. If the key is already taken and not expired, the stored record
+// is returned with claimed set to false; its Status is nil while the original
+// request is still in progress. An expired key is claimed afresh.
+func (m *IdempotencyModel) Claim(ctx context.Context, tenantID, principal, key string, requestHash []byte, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	var (
+		r       IdempotencyRecord
+		claimed bool
+	)
+
+	err := inTenant(ctx, m.DB, m.RowLevelSecurity, tenantID, func(q querier) error {
+		var err error
+		r, claimed, err = m.claim(ctx, q, tenantID, principal, key, requestHash, ttl)
+		return err
+	})
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	return r, claimed, nil
+}
+
+func (m *IdempotencyModel) claim(ctx context.Context, q querier, tenantID, principal, key string, requestHash []byte, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	var r IdempotencyRecord
+
+	stmt := `
+		INSERT INTO idempotency_keys
+		(tenant_id, principal, key, request_hash, expires_at)
+		VALUES ($1, $2, $3, $4, now() + $5 * interval '1 second')
+		ON CONFLICT (tenant_id, principal, key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status = NULL, content_type = NULL, body = NULL,
+			created_at = now(), expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < now()
+	`
+	result, err := q.ExecContext(ctx, stmt, tenantID, principal, key, requestHash, ttl.Seconds())
+	if err != nil {
+		return r, false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return r, false, err
+	}
+	if rows == 1 {
+		return IdempotencyRecord{Key: key, RequestHash: requestHash}, true, nil
+	}
+
+	stmt = `
+		SELECT key, request_hash, status, content_type, body
+		FROM idempotency_keys
+		WHERE tenant_id = $1 AND principal = $2 AND key = $3
+	`
+	err = q.QueryRowContext(ctx, stmt, tenantID, principal, key).Scan(&r.Key, &r.RequestHash, &r.Status, &r.ContentType, &r.Body)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return IdempotencyRecord{}, false, ErrNoRecord
+		} else {
+			return IdempotencyRecord{}, false, err
+		}
+	}
+
+	return r, false, nil
+}
+
+func (m *IdempotencyModel) Complete(ctx context.Context, tenantID, principal, key string, status int, contentType string, body []byte) error {
+	stmt := `
+		UPDATE idempotency_keys
+		SET status = $4, content_type = $5, body = $6
+		WHERE tenant_id = $1 AND principal = $2 AND key = $3
+	`
+	return inTenant(ctx, m.DB, m.RowLevelSecurity, tenantID, func(q querier) error {
+		_, err := q.ExecContext(ctx, stmt, tenantID, principal, key, status, contentType, body)
+		return err
+	})
+}
+
+// Release drops a claimed key so that the request can be retried.
+func (m *IdempotencyModel) Release(ctx context.Context, tenantID, principal, key string) error {
+	stmt := `
+		DELETE FROM idempotency_keys
+		WHERE tenant_id = $1 AND principal = $2 AND key = $3
+	`
+	return inTenant(ctx, m.DB, m.RowLevelSecurity, tenantID, func(q querier) error {
+		_, err := q.ExecContext(ctx, stmt, tenantID, principal, key)
+		return err
+	})
+}
+
+// DeleteExpired removes the keys of every tenant whose TTL has passed and
+// returns how many there were. It goes through a function that row level
+// security does not apply to.
+func (m *IdempotencyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	var n int64
+	err := m.DB.QueryRowContext(ctx, `SELECT delete_expired_idempotency_keys()`).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyClaim(t *testing.T) {
+	m := &IdempotencyModel{DB: newTestDB(t)}
+	ctx := context.Background()
+
+	_, claimed, err := m.Claim(ctx, "default", "key:a", "create-1", []byte("a"), time.Hour)
+	if err != nil || !claimed {
+		t.Fatalf("got claimed %t, error %v; want the key claimed", claimed, err)
+	}
+	err = m.Complete(ctx, "default", "key:a", "create-1", 201, "application/json", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An expired key of another caller.
+	_, _, err = m.Claim(ctx, "default", "key:c", "create-1", []byte("c"), -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		tenantID    string
+		principal   string
+		hash        string
+		wantClaimed bool
+		wantHash    string
+	}{
+		{name: "Same caller", tenantID: "default", principal: "key:a", hash: "a", wantClaimed: false, wantHash: "a"},
+		{name: "Other caller", tenantID: "default", principal: "key:b", hash: "b", wantClaimed: true, wantHash: "b"},
+		{name: "Other tenant", tenantID: "acme", principal: "key:a", hash: "a2", wantClaimed: true, wantHash: "a2"},
+		{name: "Expired", tenantID: "default", principal: "key:c", hash: "c2", wantClaimed: true, wantHash: "c2"},
+	}
+
+	for _, tt := range tests {
+		record, claimed, err := m.Claim(ctx, tt.tenantID, tt.principal, "create-1", []byte(tt.hash), time.Hour)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if claimed != tt.wantClaimed {
+			t.Errorf("%s: got claimed %t; want %t", tt.name, claimed, tt.wantClaimed)
+		}
+		if string(record.RequestHash) != tt.wantHash {
+			t.Errorf("%s: got request hash %q; want %q", tt.name, record.RequestHash, tt.wantHash)
+		}
+	}
+}
+
+// Keys are claimed within their tenant and deleted across tenants under row
+// level security.
+func TestIdempotencyDeleteExpired(t *testing.T) {
+	db := newTestDB(t)
+	asServiceRole(t, db)
+
+	m := &IdempotencyModel{DB: db, RowLevelSecurity: true}
+	ctx := context.Background()
+
+	for key, ttl := range map[string]time.Duration{"live": time.Hour, "expired": -time.Hour} {
+		for _, tenantID := range []string{"acme", "globex"} {
+			_, claimed, err := m.Claim(ctx, tenantID, "", key, []byte(key), ttl)
+			if err != nil || !claimed {
+				t.Fatalf("got claimed %t, error %v; want the key claimed", claimed, err)
+			}
+		}
+	}
+
+	n, err := m.DeleteExpired(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d keys deleted; want 2", n)
+	}
+}
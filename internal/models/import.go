@@ -0,0 +1,229 @@
+package models
+
+import (
+	"context"
+
+	"github.com/lib/pq"
+)
+
+type DuplicatePolicy string
+
+const (
+	DuplicateSkip   DuplicatePolicy = "skip"
+	DuplicateUpdate DuplicatePolicy = "update"
+	DuplicateFail   DuplicatePolicy = "fail"
+)
+
+type ImportResult struct {
+	Inserted int
+	Updated  int
+	Skipped  int
+	// Duplicates holds indexes of the imported subscriptions that match an
+	// existing record by user, service and start date.
+	Duplicates []int
+	// Overlaps holds indexes of the imported subscriptions whose period
+	// intersects another subscription of the same user and service, existing
+	// or imported, other than the one they duplicate.
+	Overlaps []int
+}
+
+// Import loads subscriptions into a temporary table with COPY and merges them
+// into subscriptions according to policy. With DuplicateFail nothing is
+// written if any row is a duplicate and ErrDuplicateRecord is returned. When
+// dryRun is set the transaction is rolled back after the counts are collected.
+// With RejectOverlaps nothing is written if any row overlaps and ErrOverlap
+// is returned.
+func (m *SubscriptionModel) Import(ctx context.Context, subscriptions []Subscription, policy DuplicatePolicy, dryRun bool) (result ImportResult, err error) {
+	if m.TenantID == "" {
+		return result, ErrNoTenant
+	}
+
+	ctx, end := m.trace(ctx, "Import")
+	defer func() {
+		err = classifyError(ctx, err)
+		end(err)
+	}()
+
+	tx, err := m.begin(ctx, m.DB)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+		CREATE TEMP TABLE subscriptions_import (
+			idx INT NOT NULL,
+			user_id UUID NOT NULL,
+			service_name VARCHAR(255) NOT NULL,
+			price INT NOT NULL,
+			start_date DATE NOT NULL,
+			end_date DATE NULL
+		) ON COMMIT DROP
+	`
+	_, err = tx.ExecContext(ctx, stmt)
+	if err != nil {
+		return result, err
+	}
+
+	copyStmt, err := tx.PrepareContext(ctx, pq.CopyIn("subscriptions_import", "idx", "user_id", "service_name", "price", "start_date", "end_date"))
+	if err != nil {
+		return result, err
+	}
+
+	for i, s := range subscriptions {
+		_, err = copyStmt.ExecContext(ctx, i, s.UserID, s.ServiceName, s.Price, s.StartDate, s.EndDate)
+		if err != nil {
+			copyStmt.Close()
+			return result, err
+		}
+	}
+
+	_, err = copyStmt.ExecContext(ctx)
+	if err != nil {
+		copyStmt.Close()
+		return result, err
+	}
+
+	err = copyStmt.Close()
+	if err != nil {
+		return result, err
+	}
+
+	stmt = `
+		SELECT i.idx
+		FROM subscriptions_import i
+		JOIN subscriptions s
+			ON s.tenant_id = $1 AND s.user_id = i.user_id AND s.service_name = i.service_name AND s.start_date = i.start_date
+		ORDER BY i.idx
+	`
+	rows, err := tx.QueryContext(ctx, stmt, m.TenantID)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var idx int
+		err = rows.Scan(&idx)
+		if err != nil {
+			return result, err
+		}
+		result.Duplicates = append(result.Duplicates, idx)
+	}
+
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+	rows.Close()
+
+	if policy == DuplicateFail && len(result.Duplicates) > 0 {
+		return result, ErrDuplicateRecord
+	}
+
+	if m.RejectOverlaps {
+		// Locks are taken in a fixed order, so that imports touching the
+		// same users do not deadlock.
+		stmt = `
+			SELECT pg_advisory_xact_lock(hashtextextended($1 || '/' || user_id || '/' || service_name, 0))
+			FROM (SELECT DISTINCT user_id::text, service_name FROM subscriptions_import ORDER BY 1, 2) pairs
+		`
+		_, err = tx.ExecContext(ctx, stmt, m.TenantID)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	stmt = `
+		SELECT i.idx
+		FROM subscriptions_import i
+		WHERE EXISTS (
+			SELECT 1 FROM subscriptions s
+			WHERE s.tenant_id = $1 AND s.user_id = i.user_id AND s.service_name = i.service_name AND s.start_date <> i.start_date
+				AND daterange(s.start_date, s.end_date, '[]') && daterange(i.start_date, i.end_date, '[]')
+		) OR EXISTS (
+			SELECT 1 FROM subscriptions_import j
+			WHERE j.idx <> i.idx AND j.user_id = i.user_id AND j.service_name = i.service_name
+				AND daterange(j.start_date, j.end_date, '[]') && daterange(i.start_date, i.end_date, '[]')
+		)
+		ORDER BY i.idx
+	`
+	rows, err = tx.QueryContext(ctx, stmt, m.TenantID)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var idx int
+		err = rows.Scan(&idx)
+		if err != nil {
+			return result, err
+		}
+		result.Overlaps = append(result.Overlaps, idx)
+	}
+
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+	rows.Close()
+
+	if m.RejectOverlaps && len(result.Overlaps) > 0 {
+		return result, ErrOverlap
+	}
+
+	if policy == DuplicateUpdate {
+		stmt = `
+			UPDATE subscriptions s
+			SET price = i.price, end_date = i.end_date
+			FROM subscriptions_import i
+			WHERE s.tenant_id = $1 AND s.user_id = i.user_id AND s.service_name = i.service_name AND s.start_date = i.start_date
+		`
+		res, err := tx.ExecContext(ctx, stmt, m.TenantID)
+		if err != nil {
+			return result, err
+		}
+		updated, err := res.RowsAffected()
+		if err != nil {
+			return result, err
+		}
+		result.Updated = int(updated)
+	}
+
+	stmt = `
+		INSERT INTO subscriptions
+		(tenant_id, user_id, service_name, price, start_date, end_date)
+		SELECT $1, i.user_id, i.service_name, i.price, i.start_date, i.end_date
+		FROM subscriptions_import i
+		WHERE NOT EXISTS (
+			SELECT 1 FROM subscriptions s
+			WHERE s.tenant_id = $1 AND s.user_id = i.user_id AND s.service_name = i.service_name AND s.start_date = i.start_date
+		)
+	`
+	res, err := tx.ExecContext(ctx, stmt, m.TenantID)
+	if err != nil {
+		return result, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return result, err
+	}
+	result.Inserted = int(inserted)
+
+	if policy == DuplicateSkip {
+		result.Skipped = len(result.Duplicates)
+	}
+
+	if dryRun {
+		return result, nil
+	}
+
+	// A failed commit may still have been applied, so the cache is dropped
+	// either way.
+	err = tx.Commit()
+	m.Cache.invalidate(m.TenantID)
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
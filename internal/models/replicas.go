@@ -0,0 +1,111 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Replicas hands out read replicas in round-robin order, skipping the ones
+// that failed their last health check.
+type Replicas struct {
+	dbs     []*sql.DB
+	healthy []atomic.Bool
+	next    atomic.Uint64
+	logger  *slog.Logger
+}
+
+// NewReplicas returns a set of replicas that are considered healthy until
+// the first check says otherwise.
+func NewReplicas(dbs []*sql.DB, logger *slog.Logger) *Replicas {
+	r := &Replicas{
+		dbs:     dbs,
+		healthy: make([]atomic.Bool, len(dbs)),
+		logger:  logger,
+	}
+	for i := range r.healthy {
+		r.healthy[i].Store(true)
+	}
+	return r
+}
+
+// pick returns the next healthy replica, or nil if there is none.
+func (r *Replicas) pick() *sql.DB {
+	if r == nil || len(r.dbs) == 0 {
+		return nil
+	}
+
+	start := r.next.Add(1)
+	for i := range len(r.dbs) {
+		n := int((start + uint64(i)) % uint64(len(r.dbs)))
+		if r.healthy[n].Load() {
+			return r.dbs[n]
+		}
+	}
+
+	return nil
+}
+
+// markFailed takes db out of rotation until the next successful check.
+func (r *Replicas) markFailed(db *sql.DB) {
+	for i, d := range r.dbs {
+		if d == db && r.healthy[i].Swap(false) {
+			r.logger.Warn("read replica is unavailable", "replica", i)
+		}
+	}
+}
+
+// Check pings every replica and updates its health.
+func (r *Replicas) Check(ctx context.Context) {
+	for i, db := range r.dbs {
+		err := db.PingContext(ctx)
+
+		was := r.healthy[i].Swap(err == nil)
+		switch {
+		case err != nil && was:
+			r.logger.Warn("read replica is unavailable", "replica", i, "error", err.Error())
+		case err == nil && !was:
+			r.logger.Info("read replica is available again", "replica", i)
+		}
+	}
+}
+
+// Monitor checks the replicas every interval until ctx is done.
+func (r *Replicas) Monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r.Check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Replicas) Close() error {
+	var errs []error
+	for _, db := range r.dbs {
+		errs = append(errs, db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+type primaryContextKey struct{}
+
+// WithPrimary marks ctx so that reads see the latest writes, bypassing the
+// replicas.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+func usePrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryContextKey{}).(bool)
+	return primary
+}
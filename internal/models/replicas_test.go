@@ -0,0 +1,64 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// A read that fails because its replica is unreachable is served by the
+// primary, even if the replica had returned part of the result.
+func TestReadFallsBackToPrimary(t *testing.T) {
+	refused := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	tests := []struct {
+		name    string
+		replica func(string, []driver.NamedValue) (driver.Rows, error)
+	}{
+		{
+			name: "Query fails",
+			replica: func(string, []driver.NamedValue) (driver.Rows, error) {
+				return nil, refused
+			},
+		},
+		{
+			name: "Rows fail",
+			replica: func(string, []driver.NamedValue) (driver.Rows, error) {
+				return &fakeRows{rows: [][]driver.Value{{"netflix", int64(1), int64(1)}}, err: refused}, nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		primaryDB, primary := newFakeDB(nil, "spotify", int64(300), int64(2))
+		replica := &fakeDB{handle: tt.replica}
+
+		m := &SubscriptionModel{
+			DB:       primaryDB,
+			TenantID: "default",
+			Replicas: NewReplicas([]*sql.DB{sql.OpenDB(replica)}, slog.New(slog.NewTextHandler(io.Discard, nil))),
+		}
+
+		totals, err := m.TotalsByService(context.Background(), SubscriptionFilter{})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		want := []ServiceTotal{{ServiceName: "spotify", Total: 300, Subscriptions: 2}}
+		if !reflect.DeepEqual(totals, want) {
+			t.Errorf("%s: got %v; want %v", tt.name, totals, want)
+		}
+		if got := primary.queries.Load(); got != 1 {
+			t.Errorf("%s: got %d primary queries; want 1", tt.name, got)
+		}
+		if m.Replicas.pick() != nil {
+			t.Errorf("%s: replica was not marked failed", tt.name)
+		}
+	}
+}
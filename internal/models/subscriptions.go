@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -8,6 +9,11 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Subscription struct {
@@ -19,8 +25,63 @@ type Subscription struct {
 	EndDate     *time.Time `json:"end_date,omitempty"`
 }
 
+// SubscriptionModel works with the subscriptions of a single tenant. Use
+// ForTenant to get a model for a request; queries fail with ErrNoTenant
+// when no tenant is set.
 type SubscriptionModel struct {
-	DB *sql.DB
+	DB       *sql.DB
+	TenantID string
+	// RowLevelSecurity runs every query in a transaction with app.tenant_id
+	// set, so that the row level security policies enforce the tenant as well.
+	RowLevelSecurity bool
+	// ObserveQuery, if set, receives the name of the method and how long its
+	// database work took.
+	ObserveQuery func(method string, duration time.Duration)
+	Timeouts     QueryTimeouts
+	// PageSize is the number of rows per page of List, 20 if zero.
+	PageSize int
+	// Replicas, if set, serve Get, List, Services and, without a Cache,
+	// CountTotal and TotalsByService unless the context was marked with
+	// WithPrimary.
+	Replicas *Replicas
+	// Cache, if set, keeps results of CountTotal, TotalsByService and
+	// Overlaps until the tenant's subscriptions change. The queries that fill
+	// it go to the primary.
+	Cache *ReportCache
+	// RejectOverlaps makes Insert and Update fail with an OverlapError and
+	// Import with ErrOverlap when a period intersects another subscription of
+	// the same user and service, instead of writing it and reporting the
+	// overlap. The check and the write are then serialized per user and
+	// service, so that concurrent requests cannot both pass it.
+	RejectOverlaps bool
+}
+
+// QueryTimeouts limit how long each kind of operation may run. Zero means no
+// limit besides the request context.
+type QueryTimeouts struct {
+	// Read applies to Get and List.
+	Read time.Duration
+	// Write applies to Insert, Update, Delete and Import.
+	Write time.Duration
+	// Report applies to CountTotal, TotalsByService, Services, Overlaps and
+	// ActiveByTenant.
+	Report time.Duration
+	// Export applies to Stream.
+	Export time.Duration
+}
+
+func (t QueryTimeouts) forMethod(method string) time.Duration {
+	switch method {
+	case "Get", "List":
+		return t.Read
+	case "Insert", "Update", "Delete", "Import":
+		return t.Write
+	case "CountTotal", "TotalsByService", "Services", "Overlaps", "ActiveByTenant":
+		return t.Report
+	case "Stream":
+		return t.Export
+	}
+	return 0
 }
 
 type SubscriptionFilter struct {
@@ -29,17 +90,207 @@ type SubscriptionFilter struct {
 	StartDate   *time.Time
 	EndDate     *time.Time
 	Page        *int
+	// After and Limit page through the subscriptions ordered by id, as an
+	// alternative to Page: at most Limit of them with ids greater than After.
+	After *uuid.UUID
+	Limit *int
+}
+
+var tracer = otel.Tracer("github.com/edzh1/rest-effective-mobile/internal/models")
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+func (m *SubscriptionModel) ForTenant(tenantID string) *SubscriptionModel {
+	scoped := *m
+	scoped.TenantID = tenantID
+	return &scoped
+}
+
+// trace starts a span for a model method and applies its timeout. The
+// returned function ends the span, recording err, and reports the duration
+// to ObserveQuery.
+func (m *SubscriptionModel) trace(ctx context.Context, method string) (context.Context, func(err error)) {
+	start := time.Now()
+	cancel := context.CancelFunc(func() {})
+	if timeout := m.Timeouts.forMethod(method); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	ctx, span := tracer.Start(ctx, "SubscriptionModel."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("tenant.id", m.TenantID),
+		),
+	)
+
+	return ctx, func(err error) {
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		cancel()
+
+		if m.ObserveQuery != nil {
+			m.ObserveQuery(method, time.Since(start))
+		}
+	}
+}
+
+// run calls fn with the database, or with a transaction bound to the tenant
+// when row level security is enabled.
+func (m *SubscriptionModel) run(ctx context.Context, method string, fn func(ctx context.Context, q querier) error) error {
+	return m.runIn(ctx, method, m.RowLevelSecurity, fn)
+}
+
+// runTx is run with a transaction whether or not row level security is
+// enabled.
+func (m *SubscriptionModel) runTx(ctx context.Context, method string, fn func(ctx context.Context, q querier) error) error {
+	return m.runIn(ctx, method, true, fn)
+}
+
+// runCached is run for methods whose results are cached. With a cache the
+// query goes to the primary: a replica may not have caught up with the write
+// that invalidated the cache, and its result would be served until it
+// expires. Misses are rare enough for the primary to take them.
+func (m *SubscriptionModel) runCached(ctx context.Context, method string, fn func(ctx context.Context, q querier) error) error {
+	if m.Cache != nil {
+		ctx = WithPrimary(ctx)
+	}
+	return m.runIn(ctx, method, m.RowLevelSecurity, fn)
+}
+
+// runIn calls fn with the connection chosen by conn. A read that fails on a
+// replica because the replica is unreachable is retried once on the primary,
+// so fn has to start over when it is called again.
+func (m *SubscriptionModel) runIn(ctx context.Context, method string, useTx bool, fn func(ctx context.Context, q querier) error) (err error) {
+	if m.TenantID == "" {
+		return ErrNoTenant
+	}
+
+	ctx, end := m.trace(ctx, method)
+	defer func() {
+		err = classifyError(ctx, err)
+		end(err)
+	}()
+
+	db := m.conn(ctx, method)
+	err = m.runOn(ctx, db, useTx, fn)
+	if db != m.DB && errors.Is(classifyError(ctx, err), ErrUnavailable) {
+		m.Replicas.markFailed(db)
+		db = m.DB
+		err = m.runOn(ctx, db, useTx, fn)
+	}
+
+	return err
+}
+
+func (m *SubscriptionModel) runOn(ctx context.Context, db *sql.DB, useTx bool, fn func(ctx context.Context, q querier) error) error {
+	if !useTx {
+		return fn(ctx, db)
+	}
+
+	tx, err := m.begin(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// conn returns a replica for the read-only methods that may be served by
+// one and the primary otherwise.
+func (m *SubscriptionModel) conn(ctx context.Context, method string) *sql.DB {
+	switch method {
+	case "Get", "List", "CountTotal", "TotalsByService", "Services":
+		if usePrimary(ctx) {
+			return m.DB
+		}
+		if db := m.Replicas.pick(); db != nil {
+			return db
+		}
+	}
+	return m.DB
+}
+
+func (m *SubscriptionModel) begin(ctx context.Context, db *sql.DB) (*sql.Tx, error) {
+	if m.TenantID == "" {
+		return nil, ErrNoTenant
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.RowLevelSecurity {
+		_, err = tx.ExecContext(ctx, `SELECT set_config('app.tenant_id', $1, true)`, m.TenantID)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return tx, nil
+}
+
+func (f SubscriptionFilter) where(tenantID string) (string, []interface{}) {
+	stmt := " AND tenant_id = $1"
+	argIndex := 2
+	args := []interface{}{tenantID}
+
+	if f.UserID != nil {
+		stmt += fmt.Sprintf(" AND user_id = $%d", argIndex)
+		args = append(args, *f.UserID)
+		argIndex++
+	}
+
+	if f.ServiceName != nil {
+		stmt += fmt.Sprintf(" AND service_name = $%d", argIndex)
+		args = append(args, strings.ToLower(*f.ServiceName))
+		argIndex++
+	}
+
+	if f.StartDate != nil {
+		stmt += fmt.Sprintf(" AND start_date >= $%d", argIndex)
+		args = append(args, *f.StartDate)
+		argIndex++
+	}
+
+	if f.EndDate != nil {
+		stmt += fmt.Sprintf(" AND end_date <= $%d", argIndex)
+		args = append(args, *f.EndDate)
+	}
+
+	return stmt, args
 }
 
-func (m *SubscriptionModel) Get(id uuid.UUID) (Subscription, error) {
+// Get returns the subscription with the given id. If ownerID is set, only a
+// subscription of that user is returned; the same applies to Update and Delete.
+func (m *SubscriptionModel) Get(ctx context.Context, id uuid.UUID, ownerID *uuid.UUID) (Subscription, error) {
 	var s Subscription
 	stmt := `
 		SELECT id, user_id, service_name, price, start_date, end_date
 		FROM subscriptions
-		WHERE id = $1
+		WHERE tenant_id = $1 AND id = $2 AND ($3::uuid IS NULL OR user_id = $3)
 	`
-	row := m.DB.QueryRow(stmt, id)
-	err := row.Scan(&s.ID, &s.UserID, &s.ServiceName, &s.Price, &s.StartDate, &s.EndDate)
+	err := m.run(ctx, "Get", func(ctx context.Context, q querier) error {
+		row := q.QueryRowContext(ctx, stmt, m.TenantID, id, ownerID)
+		return row.Scan(&s.ID, &s.UserID, &s.ServiceName, &s.Price, &s.StartDate, &s.EndDate)
+	})
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -52,167 +303,475 @@ func (m *SubscriptionModel) Get(id uuid.UUID) (Subscription, error) {
 	return s, nil
 }
 
-func (m *SubscriptionModel) List(filter SubscriptionFilter) ([]Subscription, error) {
+func (m *SubscriptionModel) List(ctx context.Context, filter SubscriptionFilter) ([]Subscription, error) {
 	var subscriptions []Subscription
-	limit := 20
-	argIndex := 1
-	args := []interface{}{}
-	stmt := `
-		SELECT id, user_id, service_name, price, start_date, end_date
-		FROM subscriptions
-		WHERE 1 = 1
-	`
 
-	if filter.UserID != nil {
-		stmt += fmt.Sprintf(" AND user_id = $%d", argIndex)
-		args = append(args, *filter.UserID)
-		argIndex++
+	stmt, args := m.listQuery(filter)
+	err := m.run(ctx, "List", func(ctx context.Context, q querier) error {
+		subscriptions = nil
+		return scanSubscriptions(ctx, q, stmt, args, func(s Subscription) error {
+			subscriptions = append(subscriptions, s)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if filter.ServiceName != nil {
-		stmt += fmt.Sprintf(" AND service_name = $%d", argIndex)
-		args = append(args, strings.ToLower(*filter.ServiceName))
-		argIndex++
-	}
+	return subscriptions, nil
+}
 
-	if filter.StartDate != nil {
-		stmt += fmt.Sprintf(" AND start_date >= $%d", argIndex)
-		args = append(args, *filter.StartDate)
-		argIndex++
-	}
+// Stream runs the List query and calls fn for every row as it is read from
+// the database, without collecting the result in memory. Iteration stops at
+// the first error returned by fn.
+func (m *SubscriptionModel) Stream(ctx context.Context, filter SubscriptionFilter, fn func(Subscription) error) error {
+	stmt, args := m.listQuery(filter)
+	return m.run(ctx, "Stream", func(ctx context.Context, q querier) error {
+		return scanSubscriptions(ctx, q, stmt, args, fn)
+	})
+}
 
-	if filter.EndDate != nil {
-		stmt += fmt.Sprintf(" AND end_date <= $%d", argIndex)
-		args = append(args, *filter.EndDate)
-		argIndex++
+func (m *SubscriptionModel) listQuery(filter SubscriptionFilter) (string, []interface{}) {
+	limit := m.PageSize
+	if limit == 0 {
+		limit = 20
 	}
+	where, args := filter.where(m.TenantID)
+	stmt := `
+		SELECT id, user_id, service_name, price, start_date, end_date
+		FROM subscriptions
+		WHERE 1 = 1
+	` + where
 
-	if filter.Page != nil {
-		stmt += fmt.Sprintf(" LIMIT $%d OFFSET $%d", argIndex, argIndex+1)
+	switch {
+	case filter.After != nil || filter.Limit != nil:
+		if filter.After != nil {
+			stmt += fmt.Sprintf(" AND id > $%d", len(args)+1)
+			args = append(args, *filter.After)
+		}
+		stmt += " ORDER BY id"
+		if filter.Limit != nil {
+			stmt += fmt.Sprintf(" LIMIT $%d", len(args)+1)
+			args = append(args, *filter.Limit)
+		}
+	case filter.Page != nil:
+		stmt += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
 		args = append(args, limit, (*filter.Page-1)*limit)
 	}
 
-	rows, err := m.DB.Query(stmt, args...)
+	return stmt, args
+}
+
+func scanSubscriptions(ctx context.Context, q querier, stmt string, args []interface{}, fn func(Subscription) error) error {
+	rows, err := q.QueryContext(ctx, stmt, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var s Subscription
 		err = rows.Scan(&s.ID, &s.UserID, &s.ServiceName, &s.Price, &s.StartDate, &s.EndDate)
+		if err != nil {
+			return err
+		}
+
+		err = fn(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// write runs Insert and Update, in a transaction when their overlap check has
+// to be serialized with the write.
+func (m *SubscriptionModel) write(ctx context.Context, method string, fn func(ctx context.Context, q querier) error) error {
+	if m.RejectOverlaps {
+		return m.runTx(ctx, method, fn)
+	}
+	return m.run(ctx, method, fn)
+}
+
+// checkOverlaps returns the user's subscriptions to the service whose period
+// intersects the given one. With RejectOverlaps it first takes their
+// transaction lock and fails with an OverlapError if there are any.
+func (m *SubscriptionModel) checkOverlaps(ctx context.Context, q querier, userID, serviceName string, startDate time.Time, endDate *time.Time, excludeID *uuid.UUID) ([]Subscription, error) {
+	if m.RejectOverlaps {
+		_, err := q.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, overlapLockKey(m.TenantID, userID, serviceName))
 		if err != nil {
 			return nil, err
 		}
-		subscriptions = append(subscriptions, s)
 	}
 
-	if err = rows.Err(); err != nil {
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		// The write rejects it.
+		return nil, nil
+	}
+
+	overlapping, err := m.findOverlapping(ctx, q, uid, serviceName, startDate, endDate, excludeID)
+	if err != nil {
 		return nil, err
 	}
+	if m.RejectOverlaps && len(overlapping) > 0 {
+		return nil, &OverlapError{Subscriptions: overlapping}
+	}
 
-	return subscriptions, nil
+	return overlapping, nil
+}
+
+// overlapLockKey names the advisory lock guarding the subscriptions of a
+// user to a service.
+func overlapLockKey(tenantID, userID, serviceName string) string {
+	return tenantID + "/" + userID + "/" + serviceName
 }
 
-func (m *SubscriptionModel) Insert(userID, serviceName string, price int, startDate time.Time, endDate *time.Time) (uuid.UUID, error) {
-	var id uuid.UUID
+// Insert creates a subscription and returns its id along with the
+// subscriptions its period overlaps, which RejectOverlaps refuses instead.
+func (m *SubscriptionModel) Insert(ctx context.Context, userID, serviceName string, price int, startDate time.Time, endDate *time.Time) (uuid.UUID, []Subscription, error) {
+	var (
+		id          uuid.UUID
+		overlapping []Subscription
+	)
 	stmt := `
 		INSERT INTO subscriptions
-		(user_id, service_name, price, start_date, end_date)
-		VALUES ($1, $2, $3, $4, $5)
+		(tenant_id, user_id, service_name, price, start_date, end_date)
+		VALUES ($1, $2, $3, $4, $5, $6)
 		RETURNING id
 	`
-	err := m.DB.QueryRow(stmt, userID, serviceName, price, startDate, endDate).Scan(&id)
+	err := m.write(ctx, "Insert", func(ctx context.Context, q querier) error {
+		var err error
+		overlapping, err = m.checkOverlaps(ctx, q, userID, serviceName, startDate, endDate, nil)
+		if err != nil {
+			return err
+		}
+		return q.QueryRowContext(ctx, stmt, m.TenantID, userID, serviceName, price, startDate, endDate).Scan(&id)
+	})
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, nil, err
 	}
+	m.Cache.invalidate(m.TenantID)
 
-	return id, nil
+	return id, overlapping, nil
 }
 
-func (m *SubscriptionModel) Update(id uuid.UUID, userID, serviceName string, price int, startDate time.Time, endDate *time.Time) (uuid.UUID, error) {
+// Update changes a subscription like Insert creates one.
+func (m *SubscriptionModel) Update(ctx context.Context, id uuid.UUID, ownerID *uuid.UUID, userID, serviceName string, price int, startDate time.Time, endDate *time.Time) (uuid.UUID, []Subscription, error) {
+	var (
+		rows        int64
+		overlapping []Subscription
+	)
 	stmt := `
 		UPDATE subscriptions
-		SET user_id = $2, service_name = $3, price = $4, start_date = $5, end_date = $6 
-		WHERE id = $1
+		SET user_id = $3, service_name = $4, price = $5, start_date = $6, end_date = $7
+		WHERE tenant_id = $1 AND id = $2 AND ($8::uuid IS NULL OR user_id = $8)
 	`
-	result, err := m.DB.Exec(stmt, id, userID, serviceName, price, startDate, endDate)
-	if err != nil {
-		return uuid.Nil, err
-	}
-	rows, err := result.RowsAffected()
+	err := m.write(ctx, "Update", func(ctx context.Context, q querier) error {
+		var err error
+		overlapping, err = m.checkOverlaps(ctx, q, userID, serviceName, startDate, endDate, &id)
+		if err != nil {
+			return err
+		}
+
+		result, err := q.ExecContext(ctx, stmt, m.TenantID, id, userID, serviceName, price, startDate, endDate, ownerID)
+		if err != nil {
+			return err
+		}
+		rows, err = result.RowsAffected()
+		return err
+	})
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, nil, err
 	}
 	if rows == 0 {
-		return uuid.Nil, ErrNoRecord
+		return uuid.Nil, nil, ErrNoRecord
 	}
-	return id, nil
+	m.Cache.invalidate(m.TenantID)
+	return id, overlapping, nil
 }
 
-func (m *SubscriptionModel) Delete(id uuid.UUID) error {
+func (m *SubscriptionModel) Delete(ctx context.Context, id uuid.UUID, ownerID *uuid.UUID) error {
+	var rows int64
 	stmt := `
 		DELETE FROM subscriptions
-		WHERE id = $1
+		WHERE tenant_id = $1 AND id = $2 AND ($3::uuid IS NULL OR user_id = $3)
 	`
-	result, err := m.DB.Exec(stmt, id)
-	if err != nil {
+	err := m.run(ctx, "Delete", func(ctx context.Context, q querier) error {
+		result, err := q.ExecContext(ctx, stmt, m.TenantID, id, ownerID)
+		if err != nil {
+			return err
+		}
+		rows, err = result.RowsAffected()
 		return err
-	}
-	rows, err := result.RowsAffected()
+	})
 	if err != nil {
 		return err
 	}
 	if rows == 0 {
 		return ErrNoRecord
 	}
+	m.Cache.invalidate(m.TenantID)
 	return nil
 }
 
-func (m *SubscriptionModel) CountTotal(filter SubscriptionFilter) (int, error) {
+func (m *SubscriptionModel) CountTotal(ctx context.Context, filter SubscriptionFilter) (int, error) {
+	key := "total:" + filter.cacheKey()
+	cached, generation, ok := m.Cache.lookup(m.TenantID, key)
+	if ok {
+		return cached.(int), nil
+	}
+
 	var total int
-	argIndex := 1
-	args := []interface{}{}
+	where, args := filter.where(m.TenantID)
 	stmt := `
 		SELECT COALESCE(SUM(price), 0)
 		FROM subscriptions
 		WHERE 1 = 1
+	` + where
+
+	err := m.runCached(ctx, "CountTotal", func(ctx context.Context, q querier) error {
+		return q.QueryRowContext(ctx, stmt, args...).Scan(&total)
+	})
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecord
+		} else {
+			return 0, err
+		}
+	}
+
+	m.Cache.store(m.TenantID, key, generation, total)
+
+	return total, nil
+}
+
+type ServiceTotal struct {
+	ServiceName   string `json:"service_name"`
+	Total         int    `json:"total"`
+	Subscriptions int    `json:"subscriptions"`
+}
+
+// TotalsByService is CountTotal grouped by service, ordered by name.
+func (m *SubscriptionModel) TotalsByService(ctx context.Context, filter SubscriptionFilter) ([]ServiceTotal, error) {
+	key := "totals_by_service:" + filter.cacheKey()
+	cached, generation, ok := m.Cache.lookup(m.TenantID, key)
+	if ok {
+		return cached.([]ServiceTotal), nil
+	}
+
+	totals := []ServiceTotal{}
+	where, args := filter.where(m.TenantID)
+	stmt := `
+		SELECT service_name, SUM(price), COUNT(*)
+		FROM subscriptions
+		WHERE 1 = 1
+	` + where + `
+		GROUP BY service_name
+		ORDER BY service_name
 	`
 
-	if filter.UserID != nil {
-		stmt += fmt.Sprintf(" AND user_id = $%d", argIndex)
-		args = append(args, *filter.UserID)
-		argIndex++
+	err := m.runCached(ctx, "TotalsByService", func(ctx context.Context, q querier) error {
+		totals = []ServiceTotal{}
+		rows, err := q.QueryContext(ctx, stmt, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var t ServiceTotal
+			err = rows.Scan(&t.ServiceName, &t.Total, &t.Subscriptions)
+			if err != nil {
+				return err
+			}
+			totals = append(totals, t)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if filter.ServiceName != nil {
-		stmt += fmt.Sprintf(" AND service_name = $%d", argIndex)
-		args = append(args, strings.ToLower(*filter.ServiceName))
-		argIndex++
+	m.Cache.store(m.TenantID, key, generation, totals)
+
+	return totals, nil
+}
+
+// Service describes a service by the subscriptions to it.
+type Service struct {
+	Name          string `json:"name"`
+	Subscriptions int    `json:"subscriptions"`
+	Users         int    `json:"users"`
+	MinPrice      int    `json:"min_price"`
+	MaxPrice      int    `json:"max_price"`
+}
+
+// Services returns the services with the given names, or every service if
+// names is nil, ordered by name. Names without subscriptions are left out.
+// If ownerID is set, only subscriptions of that user are counted.
+func (m *SubscriptionModel) Services(ctx context.Context, names []string, ownerID *uuid.UUID) ([]Service, error) {
+	services := []Service{}
+	stmt := `
+		SELECT service_name, COUNT(*), COUNT(DISTINCT user_id), MIN(price), MAX(price)
+		FROM subscriptions
+		WHERE tenant_id = $1 AND ($2::text[] IS NULL OR service_name = ANY($2)) AND ($3::uuid IS NULL OR user_id = $3)
+		GROUP BY service_name
+		ORDER BY service_name
+	`
+
+	err := m.run(ctx, "Services", func(ctx context.Context, q querier) error {
+		services = []Service{}
+		rows, err := q.QueryContext(ctx, stmt, m.TenantID, pq.Array(names), ownerID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var s Service
+			err = rows.Scan(&s.Name, &s.Subscriptions, &s.Users, &s.MinPrice, &s.MaxPrice)
+			if err != nil {
+				return err
+			}
+			services = append(services, s)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if filter.StartDate != nil {
-		stmt += fmt.Sprintf(" AND start_date >= $%d", argIndex)
-		args = append(args, *filter.StartDate)
-		argIndex++
+	return services, nil
+}
+
+type Overlap struct {
+	Subscription  Subscription `json:"subscription"`
+	ConflictsWith Subscription `json:"conflicts_with"`
+}
+
+// findOverlapping returns subscriptions of the user to the same service whose
+// period intersects [startDate, endDate]. A nil endDate means the period is
+// open-ended. The subscription with excludeID, if given, is left out.
+func (m *SubscriptionModel) findOverlapping(ctx context.Context, q querier, userID uuid.UUID, serviceName string, startDate time.Time, endDate *time.Time, excludeID *uuid.UUID) ([]Subscription, error) {
+	var subscriptions []Subscription
+	stmt := `
+		SELECT id, user_id, service_name, price, start_date, end_date
+		FROM subscriptions
+		WHERE tenant_id = $1 AND user_id = $2 AND service_name = $3
+			AND daterange(start_date, end_date, '[]') && daterange($4, $5, '[]')
+			AND ($6::uuid IS NULL OR id <> $6)
+		ORDER BY start_date
+	`
+	rows, err := q.QueryContext(ctx, stmt, m.TenantID, userID, serviceName, startDate, endDate, excludeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s Subscription
+		err = rows.Scan(&s.ID, &s.UserID, &s.ServiceName, &s.Price, &s.StartDate, &s.EndDate)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
 	}
 
-	if filter.EndDate != nil {
-		stmt += fmt.Sprintf(" AND end_date <= $%d", argIndex)
-		args = append(args, *filter.EndDate)
-		argIndex++
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+// Overlaps lists every pair of the user's subscriptions to the same service
+// with intersecting periods.
+func (m *SubscriptionModel) Overlaps(ctx context.Context, userID uuid.UUID) ([]Overlap, error) {
+	key := "overlaps:" + userID.String()
+	cached, generation, ok := m.Cache.lookup(m.TenantID, key)
+	if ok {
+		return cached.([]Overlap), nil
 	}
 
-	row := m.DB.QueryRow(stmt, args...)
-	err := row.Scan(&total)
+	var overlaps []Overlap
+	stmt := `
+		SELECT a.id, a.user_id, a.service_name, a.price, a.start_date, a.end_date,
+			b.id, b.user_id, b.service_name, b.price, b.start_date, b.end_date
+		FROM subscriptions a
+		JOIN subscriptions b
+			ON a.tenant_id = b.tenant_id AND a.user_id = b.user_id AND a.service_name = b.service_name AND a.id < b.id
+			AND daterange(a.start_date, a.end_date, '[]') && daterange(b.start_date, b.end_date, '[]')
+		WHERE a.tenant_id = $1 AND a.user_id = $2
+		ORDER BY a.service_name, a.start_date, b.start_date
+	`
+	err := m.runCached(ctx, "Overlaps", func(ctx context.Context, q querier) error {
+		overlaps = nil
+		rows, err := q.QueryContext(ctx, stmt, m.TenantID, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var o Overlap
+			a, b := &o.Subscription, &o.ConflictsWith
+			err = rows.Scan(&a.ID, &a.UserID, &a.ServiceName, &a.Price, &a.StartDate, &a.EndDate,
+				&b.ID, &b.UserID, &b.ServiceName, &b.Price, &b.StartDate, &b.EndDate)
+			if err != nil {
+				return err
+			}
+			overlaps = append(overlaps, o)
+		}
 
+		return rows.Err()
+	})
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return 0, ErrNoRecord
-		} else {
-			return 0, err
+		return nil, err
+	}
+
+	m.Cache.store(m.TenantID, key, generation, overlaps)
+
+	return overlaps, nil
+}
+
+// ActiveByTenant counts subscriptions active today for every tenant. It is
+// meant for monitoring and is not limited to the model's tenant, so it goes
+// through a function that row level security does not apply to.
+func (m *SubscriptionModel) ActiveByTenant(ctx context.Context) (counts map[string]int, err error) {
+	ctx, end := m.trace(ctx, "ActiveByTenant")
+	defer func() {
+		err = classifyError(ctx, err)
+		end(err)
+	}()
+
+	counts = make(map[string]int)
+	stmt := `SELECT tenant, active FROM active_subscriptions_by_tenant()`
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			tenantID string
+			count    int
+		)
+		err = rows.Scan(&tenantID, &count)
+		if err != nil {
+			return nil, err
 		}
+		counts[tenantID] = count
 	}
 
-	return total, nil
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
 }
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func date(t *testing.T, s string) time.Time {
+	t.Helper()
+
+	d, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestOverlapErrorMatchesErrOverlap(t *testing.T) {
+	var err error = &OverlapError{}
+
+	if !errors.Is(err, ErrOverlap) {
+		t.Errorf("errors.Is(%v, ErrOverlap) = false; want true", err)
+	}
+}
+
+// The overlaps of a write are found once, by the write, and either returned
+// or, with RejectOverlaps, turned into an OverlapError.
+func TestInsertOverlaps(t *testing.T) {
+	existing := uuid.New()
+
+	tests := []struct {
+		name           string
+		rejectOverlaps bool
+		wantErr        error
+		wantOverlaps   int
+		wantInserts    int
+	}{
+		{name: "Warn", wantOverlaps: 1, wantInserts: 1},
+		{name: "Reject", rejectOverlaps: true, wantErr: ErrOverlap},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var overlapQueries, inserts int
+			db, f := newFakeDB(nil)
+			f.handle = func(query string, args []driver.NamedValue) (driver.Rows, error) {
+				switch {
+				case strings.Contains(query, "daterange"):
+					overlapQueries++
+					return &fakeRows{rows: [][]driver.Value{{existing.String(), args[1].Value, "yandex plus", int64(400), date(t, "2024-06-01"), nil}}}, nil
+				case strings.Contains(query, "INSERT"):
+					inserts++
+					return &fakeRows{rows: [][]driver.Value{{uuid.NewString()}}}, nil
+				}
+				return &fakeRows{}, nil
+			}
+
+			m := &SubscriptionModel{DB: db, TenantID: "default", RejectOverlaps: tt.rejectOverlaps}
+			_, overlapping, err := m.Insert(context.Background(), uuid.NewString(), "yandex plus", 400, date(t, "2025-01-01"), nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+
+			if len(overlapping) != tt.wantOverlaps {
+				t.Errorf("got %d overlaps; want %d", len(overlapping), tt.wantOverlaps)
+			}
+			if overlapQueries != 1 {
+				t.Errorf("got %d overlap queries; want 1", overlapQueries)
+			}
+			if inserts != tt.wantInserts {
+				t.Errorf("got %d inserts; want %d", inserts, tt.wantInserts)
+			}
+		})
+	}
+}
+
+func TestInsertRejectsConcurrentOverlaps(t *testing.T) {
+	m := &SubscriptionModel{DB: newTestDB(t), TenantID: "default", RejectOverlaps: true}
+	userID := uuid.New().String()
+
+	const n = 8
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, n)
+	)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, errs[i] = m.Insert(context.Background(), userID, "yandex plus", 400, date(t, "2025-01-01"), nil)
+		}()
+	}
+	wg.Wait()
+
+	var inserted int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			inserted++
+		case !errors.Is(err, ErrOverlap):
+			t.Fatalf("got error %v; want ErrOverlap", err)
+		}
+	}
+
+	if inserted != 1 {
+		t.Errorf("got %d inserted; want 1", inserted)
+	}
+}
+
+func TestImportRejectsOverlaps(t *testing.T) {
+	m := &SubscriptionModel{DB: newTestDB(t), TenantID: "default", RejectOverlaps: true}
+	userID := uuid.New()
+
+	_, _, err := m.Insert(context.Background(), userID.String(), "yandex plus", 400, date(t, "2025-01-01"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end := date(t, "2024-12-31")
+	subscriptions := []Subscription{
+		{UserID: userID, ServiceName: "yandex plus", Price: 400, StartDate: date(t, "2024-06-01"), EndDate: &end},
+		{UserID: userID, ServiceName: "yandex plus", Price: 400, StartDate: date(t, "2025-03-01")},
+	}
+
+	result, err := m.Import(context.Background(), subscriptions, DuplicateFail, false)
+	if !errors.Is(err, ErrOverlap) {
+		t.Fatalf("got error %v; want ErrOverlap", err)
+	}
+
+	if len(result.Overlaps) != 1 || result.Overlaps[0] != 1 {
+		t.Errorf("got overlaps %v; want [1]", result.Overlaps)
+	}
+}
+
+// Monitoring sees every tenant even when row level security hides them from
+// the role the service runs as.
+func TestActiveByTenantBypassesRowLevelSecurity(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, tenantID := range []string{"acme", "globex"} {
+		m := &SubscriptionModel{DB: db, TenantID: tenantID}
+		_, _, err := m.Insert(context.Background(), uuid.New().String(), "yandex plus", 400, date(t, "2025-01-01"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	asServiceRole(t, db)
+
+	counts, err := (&SubscriptionModel{DB: db, TenantID: "acme", RowLevelSecurity: true}).ActiveByTenant(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"acme": 1, "globex": 1}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("got %v; want %v", counts, want)
+	}
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// inTenant calls fn with db or, when row level security is enabled, with a
+// transaction bound to tenantID, so that the tenant policies admit the
+// queries of fn.
+func inTenant(ctx context.Context, db *sql.DB, rowLevelSecurity bool, tenantID string, fn func(q querier) error) error {
+	if !rowLevelSecurity {
+		return fn(db)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT set_config('app.tenant_id', $1, true)`, tenantID)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"database/sql"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/edzh1/rest-effective-mobile/migrations"
+	_ "github.com/lib/pq"
+)
+
+// newTestDB connects to the throwaway database in TEST_DATABASE_URL and
+// builds the schema from the Up sections of the migrations. The public
+// schema is dropped before and after the test. Tests are skipped without
+// the variable.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resetSchema(t, db)
+
+	names, err := fs.Glob(migrations.FS(), "*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		script, err := fs.ReadFile(migrations.FS(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		up, _, _ := strings.Cut(string(script), "-- +goose Down")
+		_, err = db.Exec(up)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+
+	t.Cleanup(func() {
+		resetSchema(t, db)
+		db.Close()
+	})
+
+	return db
+}
+
+func resetSchema(t *testing.T, db *sql.DB) {
+	t.Helper()
+
+	_, err := db.Exec(`DROP SCHEMA IF EXISTS public CASCADE; CREATE SCHEMA public`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// asServiceRole switches db to a role that does not own the tables, so that
+// row level security applies to it. db is limited to a single connection to
+// keep the role.
+func asServiceRole(t *testing.T, db *sql.DB) {
+	t.Helper()
+
+	_, err := db.Exec(`
+		DROP ROLE IF EXISTS subscriptions_test_service;
+		CREATE ROLE subscriptions_test_service;
+		GRANT USAGE ON SCHEMA public TO subscriptions_test_service;
+		GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO subscriptions_test_service;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`SET ROLE subscriptions_test_service`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Exec(`RESET ROLE; DROP OWNED BY subscriptions_test_service; DROP ROLE IF EXISTS subscriptions_test_service`)
+	})
+}
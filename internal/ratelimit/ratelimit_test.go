@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type step struct {
+	// after is how long after the previous request this one is made.
+	after         time.Duration
+	key           string
+	wantAllowed   bool
+	wantRemaining int
+	wantRetry     time.Duration
+	wantReset     time.Duration
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit Limit
+		steps []step
+	}{
+		{
+			name:  "Burst then refill",
+			limit: Limit{Rate: 1, Burst: 2},
+			steps: []step{
+				{key: "a", wantAllowed: true, wantRemaining: 1, wantReset: time.Second},
+				{key: "a", wantAllowed: true, wantRemaining: 0, wantReset: 2 * time.Second},
+				{key: "a", wantAllowed: false, wantRemaining: 0, wantRetry: time.Second, wantReset: 2 * time.Second},
+				{after: 500 * time.Millisecond, key: "a", wantAllowed: false, wantRemaining: 0, wantRetry: 500 * time.Millisecond, wantReset: 1500 * time.Millisecond},
+				{after: 500 * time.Millisecond, key: "a", wantAllowed: true, wantRemaining: 0, wantReset: 2 * time.Second},
+			},
+		},
+		{
+			name:  "Keys have their own buckets",
+			limit: Limit{Rate: 1, Burst: 1},
+			steps: []step{
+				{key: "a", wantAllowed: true, wantRemaining: 0, wantReset: time.Second},
+				{key: "b", wantAllowed: true, wantRemaining: 0, wantReset: time.Second},
+				{key: "a", wantAllowed: false, wantRemaining: 0, wantRetry: time.Second, wantReset: time.Second},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		s := NewMemoryStore()
+		s.now = func() time.Time { return now }
+
+		for i, st := range tt.steps {
+			now = now.Add(st.after)
+
+			res, err := s.Take(context.Background(), st.key, tt.limit)
+			if err != nil {
+				t.Fatalf("%s, step %d: %v", tt.name, i, err)
+			}
+
+			if res.Allowed != st.wantAllowed {
+				t.Errorf("%s, step %d: got allowed %t; want %t", tt.name, i, res.Allowed, st.wantAllowed)
+			}
+			if res.Limit != tt.limit.Burst {
+				t.Errorf("%s, step %d: got limit %d; want %d", tt.name, i, res.Limit, tt.limit.Burst)
+			}
+			if res.Remaining != st.wantRemaining {
+				t.Errorf("%s, step %d: got remaining %d; want %d", tt.name, i, res.Remaining, st.wantRemaining)
+			}
+			if !near(res.RetryAfter, st.wantRetry) {
+				t.Errorf("%s, step %d: got retry after %s; want %s", tt.name, i, res.RetryAfter, st.wantRetry)
+			}
+			if !near(res.Reset, st.wantReset) {
+				t.Errorf("%s, step %d: got reset %s; want %s", tt.name, i, res.Reset, st.wantReset)
+			}
+		}
+	}
+}
+
+// Buckets are dropped once they have refilled, since a new bucket behaves
+// the same.
+func TestMemoryStorePrune(t *testing.T) {
+	limit := Limit{Rate: 1.0 / 60, Burst: 100}
+
+	tests := []struct {
+		name     string
+		taken    int
+		idle     time.Duration
+		wantKept bool
+	}{
+		{name: "Refilling", taken: 100, idle: 99 * time.Minute, wantKept: true},
+		{name: "Refilled", taken: 100, idle: 100 * time.Minute, wantKept: false},
+		{name: "Refilled sooner", taken: 10, idle: 10 * time.Minute, wantKept: false},
+		{name: "Recently used", taken: 1, idle: 0, wantKept: true},
+	}
+
+	for _, tt := range tests {
+		now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		s := NewMemoryStore()
+		s.now = func() time.Time { return now }
+
+		for range tt.taken {
+			s.Take(context.Background(), "a", limit)
+		}
+		s.lastPrune = now.Add(-time.Hour)
+
+		now = now.Add(tt.idle)
+		s.Take(context.Background(), "b", limit)
+
+		if _, kept := s.buckets["a"]; kept != tt.wantKept {
+			t.Errorf("%s: got bucket kept %t; want %t", tt.name, kept, tt.wantKept)
+		}
+	}
+}
+
+func near(got, want time.Duration) bool {
+	d := got - want
+	return d > -time.Millisecond && d < time.Millisecond
+}
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE "idempotency_keys"(
+    "key" VARCHAR(255) PRIMARY KEY,
+    "request_hash" BYTEA NOT NULL,
+    "status" INT NULL,
+    "content_type" VARCHAR(255) NULL,
+    "body" BYTEA NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "expires_at" TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX "idempotency_keys_expires_at_index" ON "idempotency_keys"("expires_at");
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS idempotency_keys;
+DROP INDEX IF EXISTS idempotency_keys_expires_at_index;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+CREATE INDEX "subscriptions_user_service_period_index" ON "subscriptions"
+    USING GIST ("user_id", "service_name", daterange("start_date", "end_date", '[]'));
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS subscriptions_user_service_period_index;
+-- +goose StatementEnd
@@ -0,0 +1,48 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "subscriptions" ADD COLUMN "tenant_id" VARCHAR(64) NOT NULL DEFAULT 'default';
+CREATE INDEX "subscriptions_tenant_id_index" ON "subscriptions"("tenant_id");
+DROP INDEX IF EXISTS subscriptions_user_service_period_index;
+CREATE INDEX "subscriptions_user_service_period_index" ON "subscriptions"
+    USING GIST ("tenant_id", "user_id", "service_name", daterange("start_date", "end_date", '[]'));
+
+ALTER TABLE "idempotency_keys" ADD COLUMN "tenant_id" VARCHAR(64) NOT NULL DEFAULT 'default';
+ALTER TABLE "idempotency_keys" DROP CONSTRAINT "idempotency_keys_pkey";
+ALTER TABLE "idempotency_keys" ADD PRIMARY KEY ("tenant_id", "key");
+
+ALTER TABLE "api_keys" ADD COLUMN "tenant_id" VARCHAR(64) NOT NULL DEFAULT 'default';
+CREATE INDEX "api_keys_tenant_id_index" ON "api_keys"("tenant_id");
+
+-- Row level security applies to roles that don't own the table. Run the
+-- service as such a role with TENANT_RLS=true to have Postgres enforce the
+-- tenant on top of the WHERE clauses.
+ALTER TABLE "subscriptions" ENABLE ROW LEVEL SECURITY;
+CREATE POLICY "subscriptions_tenant_isolation" ON "subscriptions"
+    USING ("tenant_id" = current_setting('app.tenant_id', true))
+    WITH CHECK ("tenant_id" = current_setting('app.tenant_id', true));
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP POLICY IF EXISTS subscriptions_tenant_isolation ON subscriptions;
+ALTER TABLE subscriptions DISABLE ROW LEVEL SECURITY;
+
+DROP INDEX IF EXISTS api_keys_tenant_id_index;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS tenant_id;
+
+-- Tenants may have used the same key; one of them keeps it.
+DELETE FROM idempotency_keys a
+USING idempotency_keys b
+WHERE a.key = b.key AND a.tenant_id > b.tenant_id;
+
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS tenant_id;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (key);
+
+DROP INDEX IF EXISTS subscriptions_user_service_period_index;
+DROP INDEX IF EXISTS subscriptions_tenant_id_index;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS tenant_id;
+CREATE INDEX "subscriptions_user_service_period_index" ON "subscriptions"
+    USING GIST ("user_id", "service_name", daterange("start_date", "end_date", '[]'));
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Monitoring counts the subscriptions of every tenant, which row level
+-- security hides from the service role. The function runs as the owner of
+-- the table, who is not subject to the policy.
+CREATE FUNCTION "active_subscriptions_by_tenant"()
+    RETURNS TABLE ("tenant" VARCHAR, "active" BIGINT)
+    LANGUAGE sql STABLE SECURITY DEFINER
+    SET search_path = public
+AS $$
+    SELECT s.tenant_id, COUNT(*)
+    FROM subscriptions s
+    WHERE s.start_date <= CURRENT_DATE AND (s.end_date IS NULL OR s.end_date >= CURRENT_DATE)
+    GROUP BY s.tenant_id
+$$;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP FUNCTION IF EXISTS active_subscriptions_by_tenant();
+-- +goose StatementEnd
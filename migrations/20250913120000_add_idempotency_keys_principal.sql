@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Keys are chosen by clients, so callers of a tenant must not see each
+-- other's. principal is empty for anonymous requests.
+ALTER TABLE "idempotency_keys" ADD COLUMN "principal" VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE "idempotency_keys" DROP CONSTRAINT "idempotency_keys_pkey";
+ALTER TABLE "idempotency_keys" ADD PRIMARY KEY ("tenant_id", "principal", "key");
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM idempotency_keys a
+USING idempotency_keys b
+WHERE a.tenant_id = b.tenant_id AND a.key = b.key AND a.principal > b.principal;
+
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS principal;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (tenant_id, key);
+-- +goose StatementEnd
@@ -0,0 +1,53 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "idempotency_keys" ENABLE ROW LEVEL SECURITY;
+CREATE POLICY "idempotency_keys_tenant_isolation" ON "idempotency_keys"
+    USING ("tenant_id" = current_setting('app.tenant_id', true))
+    WITH CHECK ("tenant_id" = current_setting('app.tenant_id', true));
+
+ALTER TABLE "api_keys" ENABLE ROW LEVEL SECURITY;
+CREATE POLICY "api_keys_tenant_isolation" ON "api_keys"
+    USING ("tenant_id" = current_setting('app.tenant_id', true))
+    WITH CHECK ("tenant_id" = current_setting('app.tenant_id', true));
+
+-- The tenant of a request is only known once its API key is found, and
+-- expired idempotency keys are deleted for all tenants at once. Both run as
+-- the owner of the tables, who is not subject to the policies.
+CREATE FUNCTION "api_key_by_hash"("hash" BYTEA)
+    RETURNS SETOF "api_keys"
+    LANGUAGE sql STABLE SECURITY DEFINER
+    SET search_path = public
+AS $$
+    SELECT *
+    FROM api_keys k
+    WHERE k.key_hash = hash
+        AND k.revoked_at IS NULL
+        AND (k.expires_at IS NULL OR k.expires_at > now())
+$$;
+
+CREATE FUNCTION "delete_expired_idempotency_keys"()
+    RETURNS BIGINT
+    LANGUAGE sql SECURITY DEFINER
+    SET search_path = public
+AS $$
+    WITH deleted AS (
+        DELETE FROM idempotency_keys
+        WHERE expires_at < now()
+        RETURNING 1
+    )
+    SELECT COUNT(*) FROM deleted
+$$;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP FUNCTION IF EXISTS delete_expired_idempotency_keys();
+DROP FUNCTION IF EXISTS api_key_by_hash(BYTEA);
+
+DROP POLICY IF EXISTS api_keys_tenant_isolation ON api_keys;
+ALTER TABLE api_keys DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS idempotency_keys_tenant_isolation ON idempotency_keys;
+ALTER TABLE idempotency_keys DISABLE ROW LEVEL SECURITY;
+-- +goose StatementEnd
@@ -0,0 +1,42 @@
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// LatestVersion returns the goose version of the newest migration, which is
+// the schema version this build of the service expects.
+func LatestVersion() (int64, error) {
+	entries, err := files.ReadDir(".")
+	if err != nil {
+		return 0, err
+	}
+
+	var latest int64
+	for _, e := range entries {
+		prefix, _, ok := strings.Cut(e.Name(), "_")
+		if !ok {
+			return 0, fmt.Errorf("migrations: unexpected file name %s", e.Name())
+		}
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("migrations: unexpected file name %s", e.Name())
+		}
+		latest = max(latest, version)
+	}
+
+	return latest, nil
+}
+
+// FS returns the migration files, for tests that build the schema without
+// goose.
+func FS() fs.FS {
+	return files
+}